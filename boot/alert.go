@@ -3,10 +3,13 @@ package boot
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/dream-mo/prom-elastic-alert/conf"
 	"github.com/dream-mo/prom-elastic-alert/utils"
+	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
 	"html/template"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,77 +17,223 @@ import (
 type AlertState int
 
 const (
-	Pending AlertState = iota
+	Inactive AlertState = iota
+	Pending
+	Firing
 	Resolved
 )
 
+func (as AlertState) String() string {
+	switch as {
+	case Pending:
+		return "pending"
+	case Firing:
+		return "firing"
+	case Resolved:
+		return "resolved"
+	default:
+		return "inactive"
+	}
+}
+
 type AlertContent struct {
 	Rule     *conf.Rule
 	Match    *Match
 	StartsAt *time.Time
 	EndsAt   *time.Time
 	State    AlertState
+	// ActiveAt is when the condition first matched, LastMatchAt when it matched last
+	ActiveAt    *time.Time
+	LastMatchAt time.Time
+	// SentAt is when the alert was last sent, nil until the first notification
+	SentAt *time.Time
+	// Flapping is set while the alert is held firing by the flapping detection
+	Flapping bool
+	// Restored is set on alerts loaded from redis until the first evaluation of the rule
+	Restored bool
+	// CatchUp is set on alerts found while evaluating the windows missed during a downtime
+	CatchUp bool
+	// Failure is set on the dedicated alerts of a rule whose query failed or returned no data
+	Failure *EvaluationFailure
 }
 
 type AlertMessage struct {
-	UniqueId string `json:"id"`
-	Path     string `json:"path"`
-	Payload  string `json:"payload"`
-	StartsAt *time.Time
+	UniqueId string       `json:"id"`
+	Path     string       `json:"path"`
+	Alert    Notification `json:"alert"`
+	// Notifiers are the names of the rule notifiers, their rule config is looked up when the message
+	// is sent so that the notifier secrets are not queued
+	Notifiers []string `json:"notifiers"`
+	// Payload is the alertmanager body of the messages queued by the versions before the notifiers
+	Payload string `json:"payload,omitempty"`
+	// SampleKey is the redis key of the alert sample documents
+	SampleKey string `json:"sample_key"`
+	StartsAt  *time.Time
+	CatchUp   bool `json:"catch_up,omitempty"`
+}
+
+// legacyNotification converts the alertmanager payload of a message queued before the notifiers
+func (am *AlertMessage) legacyNotification() (Notification, error) {
+	var body []struct {
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		EndsAt       *time.Time        `json:"endsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+	}
+	if e := json.Unmarshal([]byte(am.Payload), &body); e != nil {
+		return Notification{}, e
+	}
+	if len(body) == 0 {
+		return Notification{}, errors.New("empty payload")
+	}
+	status := Firing
+	if body[0].EndsAt != nil {
+		status = Resolved
+	}
+	return Notification{
+		UniqueId:     am.UniqueId,
+		Path:         am.Path,
+		Status:       status.String(),
+		Labels:       body[0].Labels,
+		Annotations:  body[0].Annotations,
+		StartsAt:     body[0].StartsAt,
+		EndsAt:       body[0].EndsAt,
+		GeneratorURL: body[0].GeneratorURL,
+		CatchUp:      am.CatchUp,
+	}, nil
 }
 
 type AlertSampleMessage struct {
-	ES    conf.EsConfig `json:"es"`
-	Index string        `json:"index"`
-	Ids   []string      `json:"ids"`
+	ES        conf.EsConfig        `json:"es"`
+	Index     string               `json:"index"`
+	Indices   []string             `json:"indices,omitempty"`
+	Ids       []string             `json:"ids"`
+	Rows      []map[string]any     `json:"rows,omitempty"`
+	Timestamp conf.TimestampConfig `json:"timestamp"`
+}
+
+// GetHits returns the sample documents, tabular query results have no documents and the matched rows are returned instead
+func (asm *AlertSampleMessage) GetHits() []any {
+	var hits []any
+	if len(asm.Ids) > 0 {
+		body := conf.BuildFindByIdsDSLBody(asm.Ids, asm.Timestamp)
+		client := xelastic.NewElasticClient(asm.ES, asm.ES.Version)
+		if client == nil {
+			return hits
+		}
+		indices := asm.Indices
+		if len(indices) == 0 {
+			indices = []string{asm.Index}
+		}
+		hits = client.FindByDSL(indices, body, nil, conf.SearchOptions{}).Hits
+	} else {
+		for _, row := range asm.Rows {
+			hits = append(hits, map[string]any{"_source": row})
+		}
+	}
+	return hits
 }
 
 func (ac *AlertContent) HasResolved() bool {
 	return ac.State == Resolved
 }
 
-func (ac *AlertContent) GetAlertMessage(generatorURL string) string {
+func (ac *AlertContent) GetAlertMessage(generatorURL string, notifiers []conf.RuleNotifier) string {
 	uniqueId := ac.Rule.UniqueId
-	payload := ac.getHttpPayload(generatorURL)
 	path := ac.Rule.FilePath
+	names := make([]string, 0, len(notifiers))
+	for _, rn := range notifiers {
+		names = append(names, rn.Name)
+	}
 	message := AlertMessage{
-		UniqueId: uniqueId,
-		Path:     path,
-		Payload:  payload,
-		StartsAt: ac.StartsAt,
+		UniqueId:  uniqueId,
+		Path:      path,
+		Alert:     ac.GetNotification(generatorURL),
+		Notifiers: names,
+		SampleKey: ac.getUrlHashKey(),
+		StartsAt:  ac.StartsAt,
+		CatchUp:   ac.CatchUp,
 	}
 	b, _ := json.Marshal(message)
 	return string(b)
 }
 
 func (ac *AlertContent) getUrlHashKey() string {
+	if len(ac.Match.Ids) == 0 {
+		return utils.MD5(ac.Match.Fingerprint() + ac.Match.StartsAt.String())
+	}
 	return utils.MD5(strings.Join(ac.Match.Ids, ""))
 }
 
-func (ac *AlertContent) getHttpPayload(generatorURL string) string {
-	end := ac.EndsAt
-	ends := ""
-	if end != nil {
-		ends = end.UTC().Format(time.RFC3339)
+// GetLabels returns the alert labels, the rule labels with the result row columns
+func (ac *AlertContent) GetLabels() map[string]string {
+	if ac.Failure != nil {
+		return ac.Failure.GetLabels(ac.Rule)
+	}
+	labels := ac.mapCopy(ac.Rule.Query.Labels)
+	for k, v := range ac.Match.GetRowLabels() {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	if ac.CatchUp {
+		labels["catch_up"] = "true"
+	}
+	return labels
+}
+
+// Fingerprint identifies the alert by its rule and labels
+func (ac *AlertContent) Fingerprint() string {
+	labels := ac.GetLabels()
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f := []string{ac.Rule.UniqueId}
+	for _, k := range keys {
+		f = append(f, k+"="+labels[k])
 	}
-	data := ac.mapCopy(ac.Rule.Query.Labels)
-	data["value"] = fmt.Sprintf("%d", ac.Match.HitsNumber)
+	return utils.MD5(strings.Join(f, ","))
+}
+
+// GetNotification returns the alert delivered to the notifiers, with the rule annotations rendered
+func (ac *AlertContent) GetNotification(generatorURL string) Notification {
+	labels := ac.GetLabels()
+	data := ac.mapCopy(labels)
+	data["value"] = ac.Match.GetValue()
+	data["catch_up"] = strconv.FormatBool(ac.CatchUp)
+	data["flapping"] = strconv.FormatBool(ac.Flapping)
 	annotations := ac.mapCopy(ac.Rule.Query.Annotations)
-	ac.parseTemplate(annotations, data)
-	b := map[string]any{
-		"labels":       ac.Rule.Query.Labels,
-		"annotations":  annotations,
-		"startsAt":     ac.StartsAt.UTC().Format(time.RFC3339),
-		"generatorURL": generatorURL,
+	if ac.Failure != nil {
+		annotations = ac.Failure.GetAnnotations(ac.Rule)
+	} else {
+		ac.parseTemplate(annotations, data)
+	}
+	// Flapping is an annotation, the alert labels stay the same while it is flapping
+	if ac.Flapping {
+		annotations["flapping"] = "true"
 	}
-	if ends != "" {
-		b["endsAt"] = ends
+	status := Firing
+	if ac.HasResolved() {
+		status = Resolved
 	}
-	body := []map[string]any{
-		b,
+	return Notification{
+		UniqueId:     ac.Rule.UniqueId,
+		Path:         ac.Rule.FilePath,
+		Status:       status.String(),
+		Labels:       labels,
+		Annotations:  annotations,
+		StartsAt:     *ac.StartsAt,
+		EndsAt:       ac.EndsAt,
+		GeneratorURL: generatorURL,
+		Value:        ac.Match.GetValue(),
+		HitsNumber:   ac.Match.HitsNumber,
+		WindowStart:  ac.Match.StartsAt,
+		WindowEnd:    ac.Match.EndsAt,
+		CatchUp:      ac.CatchUp,
 	}
-	payload, _ := json.Marshal(body)
-	return string(payload)
 }
 
 func (ac *AlertContent) parseTemplate(m map[string]string, data any) {
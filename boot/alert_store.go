@@ -0,0 +1,293 @@
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PersistedAlert is the alert state saved in redis, one hash field per alert keyed by the alert key
+type PersistedAlert struct {
+	Fingerprint   string         `json:"fingerprint"`
+	State         AlertState     `json:"state"`
+	StartsAt      *time.Time     `json:"starts_at"`
+	EndsAt        *time.Time     `json:"ends_at,omitempty"`
+	ActiveAt      *time.Time     `json:"active_at,omitempty"`
+	LastMatchAt   time.Time      `json:"last_match_at"`
+	SentAt        *time.Time     `json:"sent_at,omitempty"`
+	Flapping      bool           `json:"flapping,omitempty"`
+	Ids           []string       `json:"ids"`
+	HitsNumber    int            `json:"hits_number"`
+	Value         float64        `json:"value"`
+	Row           map[string]any `json:"row,omitempty"`
+	MatchStartsAt time.Time      `json:"match_starts_at"`
+	MatchEndsAt   time.Time      `json:"match_ends_at"`
+	// Path and Labels resolve the alert after its rule was removed
+	Path   string            `json:"path,omitempty"`
+	Labels map[string]string `json:"labels"`
+}
+
+func NewPersistedAlert(alert AlertContent) PersistedAlert {
+	return PersistedAlert{
+		Fingerprint:   alert.Fingerprint(),
+		State:         alert.State,
+		StartsAt:      alert.StartsAt,
+		EndsAt:        alert.EndsAt,
+		ActiveAt:      alert.ActiveAt,
+		LastMatchAt:   alert.LastMatchAt,
+		SentAt:        alert.SentAt,
+		Flapping:      alert.Flapping,
+		Ids:           alert.Match.Ids,
+		HitsNumber:    alert.Match.HitsNumber,
+		Value:         alert.Match.Value,
+		Row:           alert.Match.Row,
+		MatchStartsAt: alert.Match.StartsAt,
+		MatchEndsAt:   alert.Match.EndsAt,
+		Path:          alert.Rule.FilePath,
+		Labels:        alert.GetLabels(),
+	}
+}
+
+func (pa PersistedAlert) AlertContent(r *conf.Rule) AlertContent {
+	return AlertContent{
+		Rule: r,
+		Match: &Match{
+			r:          r,
+			Ids:        pa.Ids,
+			StartsAt:   pa.MatchStartsAt,
+			EndsAt:     pa.MatchEndsAt,
+			HitsNumber: pa.HitsNumber,
+			Value:      pa.Value,
+			Row:        pa.Row,
+		},
+		StartsAt:    pa.StartsAt,
+		EndsAt:      pa.EndsAt,
+		State:       pa.State,
+		ActiveAt:    pa.ActiveAt,
+		LastMatchAt: pa.LastMatchAt,
+		SentAt:      pa.SentAt,
+		Flapping:    pa.Flapping,
+		Restored:    true,
+	}
+}
+
+// setAlert stores the alert, and saves it to redis when its saved state changed
+func (ea *ElasticAlert) setAlert(alert AlertContent) {
+	r := alert.Rule
+	key := alert.Match.Fingerprint()
+	prev, ok := ea.alerts.Load(key)
+	ea.alerts.Store(key, alert)
+	bs, _ := json.Marshal(NewPersistedAlert(alert))
+	if ok {
+		prevBs, _ := json.Marshal(NewPersistedAlert(prev.(AlertContent)))
+		if string(prevBs) == string(bs) {
+			return
+		}
+	}
+	if e := redisx.Client.HSet(ctx, redisx.AlertStateHashKey, key, string(bs)).Err(); e != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hset", redisx.AlertStateHashKey, 0)
+		t := fmt.Sprintf("rule: %s save alert state error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hset", redisx.AlertStateHashKey, 1)
+}
+
+func (ea *ElasticAlert) deleteAlert(alert AlertContent) {
+	r := alert.Rule
+	key := alert.Match.Fingerprint()
+	ea.alerts.Delete(key)
+	if e := redisx.Client.HDel(ctx, redisx.AlertStateHashKey, key).Err(); e != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hdel", redisx.AlertStateHashKey, 0)
+		t := fmt.Sprintf("rule: %s delete alert state error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hdel", redisx.AlertStateHashKey, 1)
+}
+
+// deleteResolvedAlert deletes the alert of key unless it was replaced by a new alert since it was resolved
+func (ea *ElasticAlert) deleteResolvedAlert(r *conf.Rule, key string) {
+	defer ea.lockRuleAlerts(r)()
+	v, ok := ea.alerts.Load(key)
+	if ok && v.(AlertContent).State == Resolved {
+		ea.deleteAlert(v.(AlertContent))
+	}
+}
+
+// lockRuleAlerts serializes the alert updates of the rule evaluations and of the send alert job,
+// it returns the unlock function
+func (ea *ElasticAlert) lockRuleAlerts(r *conf.Rule) func() {
+	v, _ := ea.alertLocks.LoadOrStore(r.UniqueId, &sync.Mutex{})
+	lock := v.(*sync.Mutex)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// getRuleAlerts returns the alerts of the rule by alert key
+func (ea *ElasticAlert) getRuleAlerts(r *conf.Rule) map[string]AlertContent {
+	alerts := map[string]AlertContent{}
+	ea.alerts.Range(func(key, value any) bool {
+		if isRuleAlertKey(r, key.(string)) {
+			alerts[key.(string)] = value.(AlertContent)
+		}
+		return true
+	})
+	return alerts
+}
+
+// globEscaper escapes the redis match pattern special characters
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// loadAlertStates returns the saved alert states of the rule by alert key
+func (ea *ElasticAlert) loadAlertStates(r *conf.Rule) (map[string]string, error) {
+	states := map[string]string{}
+	val, err := redisx.Client.HGet(ctx, redisx.AlertStateHashKey, r.UniqueId).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if err == nil {
+		states[r.UniqueId] = val
+	}
+	// The alerts of the result row groups are saved as <unique_id>/<labels hash>
+	pattern := globEscaper.Replace(r.UniqueId) + "/*"
+	iter := redisx.Client.HScan(ctx, redisx.AlertStateHashKey, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if !iter.Next(ctx) {
+			break
+		}
+		if isRuleAlertKey(r, key) {
+			states[key] = iter.Val()
+		}
+	}
+	return states, iter.Err()
+}
+
+// restoreAlert loads the rule alerts saved before a restart or a reload. The restored alerts are not
+// sent again until the first evaluation decides whether they keep firing or are resolved.
+// The alerts of a disabled rule are resolved and their states deleted instead.
+func (ea *ElasticAlert) restoreAlert(r *conf.Rule) {
+	states, err := ea.loadAlertStates(r)
+	if err != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hget", redisx.AlertStateHashKey, 0)
+		t := fmt.Sprintf("rule: %s load alert state error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hget", redisx.AlertStateHashKey, 1)
+	for key, val := range states {
+		var pa PersistedAlert
+		if e := json.Unmarshal([]byte(val), &pa); e != nil {
+			t := fmt.Sprintf("rule: %s alert state json.Unmarshal error: %s", r.FilePath, e.Error())
+			logger.Logger.Errorln(t)
+			continue
+		}
+		if pa.StartsAt == nil {
+			continue
+		}
+		if !r.Enabled {
+			ea.resolveAlertState(r, r.UniqueId, key, pa)
+			continue
+		}
+		ea.alerts.Store(key, pa.AlertContent(r))
+		t := fmt.Sprintf("rule: %s restored %s alert", r.FilePath, pa.State)
+		logger.Logger.Infoln(t)
+	}
+}
+
+// cleanAlertStates resolves the saved alerts of the rules that no longer exist and drops their states,
+// the flapping states included
+func (ea *ElasticAlert) cleanAlertStates(rules map[string]*conf.Rule) {
+	exists := func(key string) bool {
+		_, ok := rules[key]
+		if !ok {
+			_, ok = rules[alertKeyRuleId(key)]
+		}
+		return ok
+	}
+	if keys, err := redisx.Client.HKeys(ctx, redisx.FlapStateHashKey).Result(); err == nil {
+		for _, key := range keys {
+			if !exists(key) {
+				redisx.Client.HDel(ctx, redisx.FlapStateHashKey, key)
+			}
+		}
+	}
+	states, err := redisx.Client.HGetAll(ctx, redisx.AlertStateHashKey).Result()
+	if err != nil {
+		return
+	}
+	for key, val := range states {
+		if exists(key) {
+			continue
+		}
+		uniqueId := alertKeyRuleId(key)
+		var pa PersistedAlert
+		if e := json.Unmarshal([]byte(val), &pa); e != nil {
+			redisx.Client.HDel(ctx, redisx.AlertStateHashKey, key)
+			continue
+		}
+		ea.resolveAlertState(nil, uniqueId, key, pa)
+	}
+}
+
+// resolveAlertState sends the resolve of a saved alert which was sent, and deletes its state. It is used
+// for the alerts of the disabled rules and of the removed rules, r is nil, which are never evaluated again.
+func (ea *ElasticAlert) resolveAlertState(r *conf.Rule, uniqueId string, key string, pa PersistedAlert) {
+	if pa.SentAt != nil && pa.State != Resolved && pa.StartsAt != nil {
+		endsAt := xtime.Now()
+		if r != nil {
+			alert := pa.AlertContent(r)
+			alert.State = Resolved
+			alert.EndsAt = &endsAt
+			alert.Restored = false
+			ea.publishAlert(alert)
+		} else if pa.Labels == nil {
+			t := fmt.Sprintf("rule: %s alert %s saved without labels, not resolved", pa.Path, key)
+			logger.Logger.Warningln(t)
+		} else {
+			match := Match{HitsNumber: pa.HitsNumber, Value: pa.Value, Row: pa.Row}
+			// The rule notifiers are unknown, the message is sent to the default notifiers
+			message := AlertMessage{
+				UniqueId: uniqueId,
+				Path:     pa.Path,
+				Alert: Notification{
+					UniqueId:    uniqueId,
+					Path:        pa.Path,
+					Status:      Resolved.String(),
+					Labels:      pa.Labels,
+					Annotations: map[string]string{},
+					StartsAt:    *pa.StartsAt,
+					EndsAt:      &endsAt,
+					Value:       match.GetValue(),
+					HitsNumber:  pa.HitsNumber,
+					WindowStart: pa.MatchStartsAt,
+					WindowEnd:   pa.MatchEndsAt,
+				},
+				StartsAt: pa.StartsAt,
+			}
+			bs, _ := json.Marshal(message)
+			if e := redisx.Client.LPush(ctx, redisx.AlertQueueListKey, string(bs)).Err(); e != nil {
+				go ea.addOpRedisMetrics(uniqueId, pa.Path, "lpush", redisx.AlertQueueListKey, 0)
+				t := fmt.Sprintf("rule: %s resolve alert %s error: %s", pa.Path, key, e.Error())
+				logger.Logger.Errorln(t)
+				return
+			}
+			go ea.addOpRedisMetrics(uniqueId, pa.Path, "lpush", redisx.AlertQueueListKey, 1)
+		}
+		t := fmt.Sprintf("rule: %s alert %s resolved, the rule is removed or disabled", pa.Path, key)
+		logger.Logger.Infoln(t)
+	}
+	if e := redisx.Client.HDel(ctx, redisx.AlertStateHashKey, key).Err(); e != nil {
+		go ea.addOpRedisMetrics(uniqueId, pa.Path, "hdel", redisx.AlertStateHashKey, 0)
+		return
+	}
+	go ea.addOpRedisMetrics(uniqueId, pa.Path, "hdel", redisx.AlertStateHashKey, 1)
+}
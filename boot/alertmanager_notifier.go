@@ -0,0 +1,56 @@
+package boot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/utils/alertmanager"
+	"time"
+)
+
+// AlertmanagerNotifier posts the alerts to the alertmanager v2 api
+type AlertmanagerNotifier struct {
+	Url       string `yaml:"url"`
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+}
+
+func (an *AlertmanagerNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, an); e != nil {
+		return e
+	}
+	if an.Url == "" {
+		return errors.New("url is required")
+	}
+	return nil
+}
+
+func (an *AlertmanagerNotifier) Notify(n Notification) error {
+	ok, code := alertmanager.HttpSendAlert(an.Url, an.BasicAuth.Username, an.BasicAuth.Password, an.getPayload(n))
+	if !ok {
+		return fmt.Errorf("send alert to alertmanager error, status: %d", code)
+	}
+	if code < 200 || code >= 300 {
+		return fmt.Errorf("alertmanager response status: %d", code)
+	}
+	return nil
+}
+
+func (an *AlertmanagerNotifier) getPayload(n Notification) string {
+	b := map[string]any{
+		"labels":       n.Labels,
+		"annotations":  n.Annotations,
+		"startsAt":     n.StartsAt.UTC().Format(time.RFC3339),
+		"generatorURL": n.GeneratorURL,
+	}
+	if n.EndsAt != nil {
+		b["endsAt"] = n.EndsAt.UTC().Format(time.RFC3339)
+	}
+	body := []map[string]any{
+		b,
+	}
+	payload, _ := json.Marshal(body)
+	return string(payload)
+}
@@ -0,0 +1,145 @@
+package boot
+
+import (
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+const defaultCatchUpMaxRange = time.Hour
+
+// catchUp evaluates the range [from, to) missed while the rule was not running in chunks of the rule
+// query window, the range is bounded by catch_up.max_range. Every match of a chunk is sent as a catch-up
+// alert ending at the chunk end, it is not tracked by the alert lifecycle. Every chunk is claimed in
+// redis before it is evaluated, so that only one replica sends its alerts.
+func (ea *ElasticAlert) catchUp(r *conf.Rule, guard *ClusterGuard, f RuleType, from time.Time, to time.Time) {
+	c := ea.appConf.CatchUp
+	if !c.Enabled {
+		return
+	}
+	maxRange := c.MaxRange.GetTimeDuration()
+	if maxRange == 0 {
+		maxRange = defaultCatchUpMaxRange
+	}
+	chunk := to.Sub(ea.getQueryStart(r, to))
+	if to.Sub(from) > maxRange {
+		t := fmt.Sprintf("rule: %s catch-up limited to %s, missed from %s", r.FilePath, maxRange, xtime.TimeFormatISO8601(from))
+		logger.Logger.Warningln(t)
+		// Whole chunks are skipped, the chunks keep the same starts on every replica
+		skipped := (to.Sub(from) - maxRange + chunk - 1) / chunk
+		from = from.Add(skipped * chunk)
+	}
+	t := fmt.Sprintf("rule: %s catch-up from %s to %s", r.FilePath, xtime.TimeFormatISO8601(from), xtime.TimeFormatISO8601(to))
+	logger.Logger.Infoln(t)
+	for start := from; start.Before(to); start = start.Add(chunk) {
+		end := start.Add(chunk)
+		if end.After(to) {
+			end = to
+		}
+		if !ea.claimCatchUp(r, start, maxRange+chunk) {
+			continue
+		}
+		matches, err := ea.queryMatches(r, guard, f, start, end)
+		if err != nil {
+			t := fmt.Sprintf("rule: %s catch-up from %s error: %s", r.FilePath, xtime.TimeFormatISO8601(start), err.Error())
+			logger.Logger.Errorln(t)
+			continue
+		}
+		for i := range matches {
+			match := matches[i]
+			endsAt := end
+			ea.publishAlert(AlertContent{
+				Rule:     r,
+				Match:    &match,
+				StartsAt: &match.StartsAt,
+				EndsAt:   &endsAt,
+				State:    Firing,
+				CatchUp:  true,
+			})
+		}
+	}
+}
+
+// claimCatchUp claims the catch-up chunk starting at start, it returns false when another replica claimed it
+func (ea *ElasticAlert) claimCatchUp(r *conf.Rule, start time.Time, expire time.Duration) bool {
+	key := fmt.Sprintf("%s%s:%d", redisx.CatchUpKeyPrefix, r.UniqueId, start.UnixMilli())
+	ok, err := redisx.Client.SetNX(ctx, key, xtime.Now().UnixMilli(), expire).Result()
+	if err != nil {
+		// The chunk is evaluated when redis is unavailable, a duplicate is better than a lost alert
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "setnx", key, 0)
+		t := fmt.Sprintf("rule: %s claim catch-up error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return true
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "setnx", key, 1)
+	if !ok {
+		t := fmt.Sprintf("rule: %s catch-up from %s claimed by another replica", r.FilePath, xtime.TimeFormatISO8601(start))
+		logger.Logger.Debugln(t)
+	}
+	return ok
+}
+
+// queryMatches evaluates the rule over [start, end] without the sliding window of the document queries
+func (ea *ElasticAlert) queryMatches(r *conf.Rule, guard *ClusterGuard, f RuleType, start time.Time, end time.Time) ([]Match, error) {
+	switch r.GetQueryMode() {
+	case conf.QueryModeSQL, conf.QueryModeESQL:
+		matches, _, err := ea.runRowQuery(r, guard, start, end)
+		return FilterRowMatchCondition(r, matches), err
+	case conf.QueryModeEQL:
+		matches, _, err := ea.runEQLQuery(r, guard, f, start, end)
+		return matches, err
+	default:
+		hits, err := ea.runRuleQuery(r, guard, start, end, nil)
+		if err != nil {
+			return nil, err
+		}
+		return toMatches(f.FilterMatchCondition(r, f.GetMatches(r, hits))), nil
+	}
+}
+
+// getQueryStart returns the start of the range a rule evaluation ending at end queries, EQL sequences
+// are searched over buffer_time, the other modes over the rule timeframe
+func (ea *ElasticAlert) getQueryStart(r *conf.Rule, end time.Time) time.Time {
+	bufferTime := ea.appConf.BufferTime.GetTimeDuration()
+	if r.GetQueryMode() == conf.QueryModeEQL {
+		return end.Add(-bufferTime)
+	}
+	start, _ := r.GetQueryWindow(end, bufferTime)
+	return start
+}
+
+// loadEvaluatedAt returns the end time of the last successful evaluation of the rule
+func (ea *ElasticAlert) loadEvaluatedAt(r *conf.Rule) *time.Time {
+	key := redisx.RuleEvaluatedKeyPrefix + r.UniqueId
+	val, err := redisx.Client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "get", key, 0)
+		t := fmt.Sprintf("rule: %s load evaluated time error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return nil
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "get", key, 1)
+	evaluatedAt, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return nil
+	}
+	return &evaluatedAt
+}
+
+func (ea *ElasticAlert) saveEvaluatedAt(r *conf.Rule, end time.Time) {
+	key := redisx.RuleEvaluatedKeyPrefix + r.UniqueId
+	if e := redisx.Client.Set(ctx, key, end.Format(time.RFC3339Nano), 0).Err(); e != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "set", key, 0)
+		t := fmt.Sprintf("rule: %s save evaluated time error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "set", key, 1)
+}
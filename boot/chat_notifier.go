@@ -0,0 +1,82 @@
+package boot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"net/http"
+	"strings"
+)
+
+// chatField is a field of the default chat message layout
+type chatField struct {
+	Title string
+	Value string
+}
+
+// chatTitle returns the title of the default chat message layout, e.g. [FIRING] NginxErrorLog
+func chatTitle(n Notification) string {
+	return fmt.Sprintf("[%s] %s", strings.ToUpper(n.Status), n.Labels["alertname"])
+}
+
+// chatText returns the summary and the description annotations
+func chatText(n Notification) string {
+	texts := []string{}
+	for _, k := range []string{"summary", "description"} {
+		if v := n.Annotations[k]; v != "" {
+			texts = append(texts, v)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// chatFields returns the alertname, the severity, the count and the time window of the alert
+func chatFields(n Notification) []chatField {
+	fields := []chatField{
+		{Title: "Alertname", Value: n.Labels["alertname"]},
+	}
+	if severity := n.Labels["severity"]; severity != "" {
+		fields = append(fields, chatField{Title: "Severity", Value: severity})
+	}
+	fields = append(fields,
+		chatField{Title: "Count", Value: n.Value},
+		chatField{Title: "Time window", Value: chatTimeWindow(n)},
+	)
+	return fields
+}
+
+func chatTimeWindow(n Notification) string {
+	if n.WindowStart.IsZero() {
+		return xtime.TimeFormatISO8601(n.StartsAt)
+	}
+	if n.WindowEnd.IsZero() || n.WindowEnd.Equal(n.WindowStart) {
+		return xtime.TimeFormatISO8601(n.WindowStart)
+	}
+	return xtime.TimeFormatISO8601(n.WindowStart) + " ~ " + xtime.TimeFormatISO8601(n.WindowEnd)
+}
+
+// chatColor returns the firing or the resolved color
+func chatColor(n Notification, firing string, resolved string) string {
+	if n.IsResolved() {
+		return resolved
+	}
+	return firing
+}
+
+// postNotifyJSON posts the json body to the url, headers are added to the request
+func postNotifyJSON(url string, v any, headers map[string]string) ([]byte, error) {
+	bs, e := json.Marshal(v)
+	if e != nil {
+		return nil, e
+	}
+	req, e := http.NewRequest(http.MethodPost, url, bytes.NewReader(bs))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return doNotifyRequest(req)
+}
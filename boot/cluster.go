@@ -0,0 +1,160 @@
+package boot
+
+import (
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+const (
+	SkippedCircuitOpen        = "circuit_open"
+	SkippedInactive           = "inactive_time"
+	defaultCircuitOpenTimeout = time.Second * 30
+)
+
+// ClusterGuard limits the in-flight searches against one elasticsearch cluster,
+// and opens a circuit breaker after consecutive failures so that rules stop querying it.
+// After the open timeout one evaluation is let through as a half-open probe.
+type ClusterGuard struct {
+	EsAddress        string
+	sem              chan struct{}
+	semLock          sync.Mutex
+	lock             sync.Mutex
+	breakerEnabled   bool
+	failureThreshold uint
+	openTimeout      time.Duration
+	state            CircuitState
+	failures         uint
+	openedAt         time.Time
+	probeAt          *time.Time
+}
+
+// Allow reports whether a rule evaluation may query the cluster now
+func (cg *ClusterGuard) Allow() bool {
+	if !cg.breakerEnabled {
+		return true
+	}
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	now := time.Now()
+	switch cg.state {
+	case CircuitOpen:
+		if now.Sub(cg.openedAt) < cg.openTimeout {
+			return false
+		}
+		cg.state = CircuitHalfOpen
+		cg.probeAt = &now
+		return true
+	case CircuitHalfOpen:
+		// Only one probe at a time, but never wait forever on a probe that did not report back
+		if cg.probeAt != nil && now.Sub(*cg.probeAt) < cg.openTimeout {
+			return false
+		}
+		cg.probeAt = &now
+		return true
+	default:
+		return true
+	}
+}
+
+// Acquire blocks until an in-flight search slot is available
+func (cg *ClusterGuard) Acquire() {
+	cg.sem <- struct{}{}
+}
+
+func (cg *ClusterGuard) Release() {
+	<-cg.sem
+}
+
+// AcquireN blocks until min(n, max_concurrent_searches) slots are available and returns the number of
+// slots acquired. Multiple slots are acquired one caller at a time, so that two callers never wait on
+// each other's partially acquired slots.
+func (cg *ClusterGuard) AcquireN(n int) int {
+	if n > cap(cg.sem) {
+		n = cap(cg.sem)
+	}
+	cg.semLock.Lock()
+	defer cg.semLock.Unlock()
+	for i := 0; i < n; i++ {
+		cg.sem <- struct{}{}
+	}
+	return n
+}
+
+func (cg *ClusterGuard) ReleaseN(n int) {
+	for i := 0; i < n; i++ {
+		<-cg.sem
+	}
+}
+
+// Report feeds the status code of a finished request into the circuit breaker
+func (cg *ClusterGuard) Report(statusCode int) {
+	if !cg.breakerEnabled {
+		return
+	}
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	if !isClusterFailure(statusCode) {
+		cg.state = CircuitClosed
+		cg.failures = 0
+		cg.probeAt = nil
+		return
+	}
+	cg.failures++
+	if cg.state == CircuitHalfOpen || cg.failures >= cg.failureThreshold {
+		cg.state = CircuitOpen
+		cg.openedAt = time.Now()
+		cg.probeAt = nil
+	}
+}
+
+func (cg *ClusterGuard) State() CircuitState {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	return cg.state
+}
+
+func (cg *ClusterGuard) InFlight() int {
+	return len(cg.sem)
+}
+
+func isClusterFailure(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == xelastic.HttpTransportErrorCode ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
+
+func NewClusterGuard(esAddress string, c *conf.AppConfig) *ClusterGuard {
+	es := c.Elasticsearch
+	maxSearches := es.MaxConcurrentSearches
+	if maxSearches == 0 {
+		maxSearches = 1
+	}
+	openTimeout := es.CircuitBreaker.OpenTimeout.GetTimeDuration()
+	if openTimeout == 0 {
+		openTimeout = defaultCircuitOpenTimeout
+	}
+	threshold := es.CircuitBreaker.FailureThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+	return &ClusterGuard{
+		EsAddress:        esAddress,
+		sem:              make(chan struct{}, maxSearches),
+		breakerEnabled:   es.CircuitBreaker.Enabled,
+		failureThreshold: threshold,
+		openTimeout:      openTimeout,
+		state:            CircuitClosed,
+	}
+}
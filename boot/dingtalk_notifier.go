@@ -0,0 +1,84 @@
+package boot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DingTalkNotifier sends markdown messages to a DingTalk group robot, signed with the robot secret
+type DingTalkNotifier struct {
+	WebhookUrl string   `yaml:"webhook_url"`
+	Secret     string   `yaml:"secret"`
+	AtMobiles  []string `yaml:"at_mobiles"`
+	IsAtAll    bool     `yaml:"is_at_all"`
+	Template   string   `yaml:"template"`
+}
+
+var dingTalkColors = map[string]string{
+	"firing":   "#F56C6C",
+	"critical": "#F56C6C",
+	"warning":  "#E6A23C",
+	"resolved": "#67C23A",
+}
+
+func (dn *DingTalkNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, dn); e != nil {
+		return e
+	}
+	if dn.WebhookUrl == "" {
+		return errors.New("webhook_url is required")
+	}
+	return nil
+}
+
+func (dn *DingTalkNotifier) Notify(n Notification) error {
+	text, e := renderMarkdown("dingtalk", dn.Template, n, dingTalkColors, func(color string, text string) string {
+		return fmt.Sprintf(`<font color="%s">%s</font>`, color, text)
+	})
+	if e != nil {
+		return fmt.Errorf("dingtalk template error: %s", e.Error())
+	}
+	// The mobiles must be in the text to be notified
+	for _, mobile := range dn.AtMobiles {
+		text += " @" + mobile
+	}
+	msg := map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]any{
+			"title": chatTitle(n),
+			"text":  text,
+		},
+		"at": map[string]any{
+			"atMobiles": dn.AtMobiles,
+			"isAtAll":   dn.IsAtAll,
+		},
+	}
+	body, e := postNotifyJSON(dn.getUrl(), msg, nil)
+	if e != nil {
+		return e
+	}
+	return checkBotResponse(body)
+}
+
+// getUrl returns the webhook url with the timestamp and the sign of the secret
+func (dn *DingTalkNotifier) getUrl() string {
+	if dn.Secret == "" {
+		return dn.WebhookUrl
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	h := hmac.New(sha256.New, []byte(dn.Secret))
+	h.Write([]byte(timestamp + "\n" + dn.Secret))
+	sign := url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	sep := "?"
+	if strings.Contains(dn.WebhookUrl, "?") {
+		sep = "&"
+	}
+	return dn.WebhookUrl + sep + "timestamp=" + timestamp + "&sign=" + sign
+}
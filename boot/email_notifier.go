@@ -0,0 +1,353 @@
+package boot
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EmailTLSNone     = "none"
+	EmailTLSStartTLS = "starttls"
+	EmailTLS         = "tls"
+
+	EmailAttachNDJSON = "ndjson"
+	EmailAttachCSV    = "csv"
+
+	// emailSendTimeout bounds the whole smtp exchange, a stalled server does not block the notifications
+	emailSendTimeout = 30 * time.Second
+)
+
+var defaultEmailSubject = `[{{if .IsResolved}}RESOLVED{{else}}FIRING{{end}}] {{.Labels.alertname}}`
+
+var defaultEmailText = `{{.Labels.alertname}} is {{.Status}}
+{{range $k, $v := .Annotations}}
+{{$k}}: {{$v}}{{end}}
+
+Severity: {{.Labels.severity}}
+Count: {{.Value}}
+Starts at: {{formatTime .StartsAt}}{{if .EndsAt}}
+Ends at: {{formatTime .EndsAt}}{{end}}
+Details: {{.GeneratorURL}}
+`
+
+var defaultEmailHtml = `<h3>{{.Labels.alertname}} is {{.Status}}</h3>
+{{range $k, $v := .Annotations}}<p><b>{{$k}}</b>: {{$v}}</p>
+{{end}}<table border="1" cellpadding="4" cellspacing="0">
+<tr><td>Severity</td><td>{{.Labels.severity}}</td></tr>
+<tr><td>Count</td><td>{{.Value}}</td></tr>
+<tr><td>Starts at</td><td>{{formatTime .StartsAt}}</td></tr>{{if .EndsAt}}
+<tr><td>Ends at</td><td>{{formatTime .EndsAt}}</td></tr>{{end}}
+</table>
+<p><a href="{{.GeneratorURL}}">Details</a></p>
+`
+
+// EmailNotifier sends the alerts with smtp, the mail has a text and a html body, and optionally
+// the sample documents attached as ndjson or csv. Recipients are usually set by the rule notifier config.
+type EmailNotifier struct {
+	Host               string   `yaml:"host"`
+	Port               int      `yaml:"port" default:"25"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	TLS                string   `yaml:"tls" default:"starttls"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	From               string   `yaml:"from"`
+	To                 []string `yaml:"to"`
+	Cc                 []string `yaml:"cc"`
+	Subject            string   `yaml:"subject"`
+	TextBody           string   `yaml:"text_body"`
+	HtmlBody           string   `yaml:"html_body"`
+	AttachSamples      string   `yaml:"attach_samples"`
+	MaxSamples         int      `yaml:"max_samples" default:"100"`
+}
+
+func (en *EmailNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, en); e != nil {
+		return e
+	}
+	if en.Host == "" {
+		return errors.New("host is required")
+	}
+	if en.From == "" {
+		return errors.New("from is required")
+	}
+	switch en.TLS {
+	case EmailTLSNone, EmailTLSStartTLS, EmailTLS:
+	default:
+		return fmt.Errorf("tls must be one of none, starttls, tls, got %s", en.TLS)
+	}
+	switch en.AttachSamples {
+	case "", EmailAttachNDJSON, EmailAttachCSV:
+	default:
+		return fmt.Errorf("attach_samples must be ndjson or csv, got %s", en.AttachSamples)
+	}
+	return nil
+}
+
+// SampleLimit loads the sample documents only when they are attached
+func (en *EmailNotifier) SampleLimit() int {
+	if en.AttachSamples == "" {
+		return 0
+	}
+	return en.MaxSamples
+}
+
+func (en *EmailNotifier) Notify(n Notification) error {
+	recipients := append(append([]string{}, en.To...), en.Cc...)
+	if len(recipients) == 0 {
+		return errors.New("email has no recipient, set to in the rule notifier config")
+	}
+	msg, e := en.getMessage(n)
+	if e != nil {
+		return e
+	}
+	return en.send(recipients, msg)
+}
+
+func (en *EmailNotifier) getMessage(n Notification) ([]byte, error) {
+	subject, e := renderNotifierTemplate("subject", en.orDefault(en.Subject, defaultEmailSubject), n)
+	if e != nil {
+		return nil, fmt.Errorf("email subject template error: %s", e.Error())
+	}
+	text, e := renderNotifierTemplate("text_body", en.orDefault(en.TextBody, defaultEmailText), n)
+	if e != nil {
+		return nil, fmt.Errorf("email text_body template error: %s", e.Error())
+	}
+	html, e := en.renderHtml(n)
+	if e != nil {
+		return nil, fmt.Errorf("email html_body template error: %s", e.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	mixed := multipart.NewWriter(buf)
+	// The mail sent to cc recipients only has the empty group as To
+	to := "undisclosed-recipients:;"
+	if len(en.To) > 0 {
+		to = strings.Join(en.To, ", ")
+	}
+	header := []string{
+		"From: " + en.From,
+		"To: " + to,
+	}
+	if len(en.Cc) > 0 {
+		header = append(header, "Cc: "+strings.Join(en.Cc, ", "))
+	}
+	header = append(header,
+		"Subject: "+mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)),
+		"Date: "+time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary="+mixed.Boundary(),
+	)
+	head := strings.Join(header, "\r\n") + "\r\n\r\n"
+
+	alternative := &bytes.Buffer{}
+	alt := multipart.NewWriter(alternative)
+	if e := writeQuotedPrintablePart(alt, "text/plain; charset=utf-8", text); e != nil {
+		return nil, e
+	}
+	if e := writeQuotedPrintablePart(alt, "text/html; charset=utf-8", html); e != nil {
+		return nil, e
+	}
+	_ = alt.Close()
+	part, e := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=" + alt.Boundary()}})
+	if e != nil {
+		return nil, e
+	}
+	_, _ = part.Write(alternative.Bytes())
+
+	if en.AttachSamples != "" && len(n.Samples) > 0 {
+		name, contentType, data, e := en.getAttachment(n)
+		if e != nil {
+			return nil, e
+		}
+		part, e := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if e != nil {
+			return nil, e
+		}
+		_, _ = part.Write([]byte(wrapBase64(data)))
+	}
+	_ = mixed.Close()
+	return append([]byte(head), buf.Bytes()...), nil
+}
+
+// renderHtml renders the html body with html/template, so that the alert values are escaped
+func (en *EmailNotifier) renderHtml(n Notification) (string, error) {
+	t, e := htmlTemplate.New("html_body").Funcs(htmlTemplate.FuncMap(notifierFuncs)).Parse(en.orDefault(en.HtmlBody, defaultEmailHtml))
+	if e != nil {
+		return "", e
+	}
+	bf := bytes.NewBufferString("")
+	if e := t.Execute(bf, n); e != nil {
+		return "", e
+	}
+	return bf.String(), nil
+}
+
+// getAttachment returns the file name, the content type and the content of the sample documents
+func (en *EmailNotifier) getAttachment(n Notification) (string, string, []byte, error) {
+	name := n.Labels["alertname"]
+	if name == "" {
+		name = "samples"
+	}
+	buf := &bytes.Buffer{}
+	if en.AttachSamples == EmailAttachNDJSON {
+		for _, sample := range n.Samples {
+			bs, e := json.Marshal(sample)
+			if e != nil {
+				return "", "", nil, e
+			}
+			buf.Write(bs)
+			buf.WriteByte('\n')
+		}
+		return name + ".ndjson", "application/x-ndjson", buf.Bytes(), nil
+	}
+	// The csv columns are the top level fields of all the samples, nested values are json encoded
+	columns := map[string]bool{}
+	for _, sample := range n.Samples {
+		for k := range sample {
+			columns[k] = true
+		}
+	}
+	header := make([]string, 0, len(columns))
+	for k := range columns {
+		header = append(header, k)
+	}
+	sort.Strings(header)
+	w := csv.NewWriter(buf)
+	_ = w.Write(header)
+	for _, sample := range n.Samples {
+		record := make([]string, len(header))
+		for i, k := range header {
+			record[i] = csvValue(sample[k])
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	return name + ".csv", "text/csv; charset=utf-8", buf.Bytes(), w.Error()
+}
+
+func (en *EmailNotifier) send(recipients []string, msg []byte) error {
+	addr := net.JoinHostPort(en.Host, strconv.Itoa(en.Port))
+	tlsConfig := &tls.Config{ServerName: en.Host, InsecureSkipVerify: en.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: notifierHttpClient.Timeout}
+	var conn net.Conn
+	var e error
+	if en.TLS == EmailTLS {
+		conn, e = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, e = dialer.Dial("tcp", addr)
+	}
+	if e != nil {
+		return e
+	}
+	// The deadline also covers the STARTTLS handshake, which runs on the same connection
+	if e := conn.SetDeadline(time.Now().Add(emailSendTimeout)); e != nil {
+		_ = conn.Close()
+		return e
+	}
+	c, e := smtp.NewClient(conn, en.Host)
+	if e != nil {
+		_ = conn.Close()
+		return e
+	}
+	defer c.Close()
+	if en.TLS == EmailTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS, set tls to none to send in plaintext")
+		}
+		if e := c.StartTLS(tlsConfig); e != nil {
+			return e
+		}
+	}
+	if en.Username != "" {
+		if e := c.Auth(smtp.PlainAuth("", en.Username, en.Password, en.Host)); e != nil {
+			return e
+		}
+	}
+	if e := c.Mail(en.From); e != nil {
+		return e
+	}
+	for _, rcpt := range recipients {
+		if e := c.Rcpt(rcpt); e != nil {
+			return e
+		}
+	}
+	w, e := c.Data()
+	if e != nil {
+		return e
+	}
+	if _, e := w.Write(msg); e != nil {
+		return e
+	}
+	if e := w.Close(); e != nil {
+		return e
+	}
+	return c.Quit()
+}
+
+func (en *EmailNotifier) orDefault(tpl string, def string) string {
+	if tpl == "" {
+		return def
+	}
+	return tpl
+}
+
+func writeQuotedPrintablePart(w *multipart.Writer, contentType string, content string) error {
+	part, e := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if e != nil {
+		return e
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, e := qp.Write([]byte(content)); e != nil {
+		return e
+	}
+	return qp.Close()
+}
+
+// wrapBase64 encodes the data in base64 lines of 76 characters
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	lines := []string{}
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	return strings.Join(lines, "\r\n")
+}
+
+func csvValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case map[string]any, []any:
+		bs, _ := json.Marshal(val)
+		return string(bs)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
@@ -0,0 +1,234 @@
+package boot
+
+import (
+	"encoding/base64"
+	"github.com/creasty/defaults"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what the stand-in smtp server received
+type smtpSession struct {
+	commands []string
+	rcpts    []string
+	data     []byte
+}
+
+// startSMTPServer serves one smtp session on a local port, extensions are advertised in the EHLO reply
+func startSMTPServer(t *testing.T, extensions ...string) (int, <-chan smtpSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		s := smtpSession{}
+		defer func() { sessions <- s }()
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+			s.commands = append(s.commands, cmd)
+			switch cmd {
+			case "EHLO":
+				replies := append([]string{"localhost"}, extensions...)
+				for i, r := range replies {
+					sep := "-"
+					if i == len(replies)-1 {
+						sep = " "
+					}
+					_ = tp.PrintfLine("250%s%s", sep, r)
+				}
+			case "RCPT":
+				s.rcpts = append(s.rcpts, strings.Trim(line[strings.Index(line, ":")+1:], "<> "))
+				_ = tp.PrintfLine("250 OK")
+			case "DATA":
+				_ = tp.PrintfLine("354 Go ahead")
+				s.data, err = tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				_ = tp.PrintfLine("250 OK")
+			case "QUIT":
+				_ = tp.PrintfLine("221 Bye")
+				return
+			default:
+				_ = tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func testEmailNotifier(t *testing.T, port int, config map[string]any) *EmailNotifier {
+	xtime.Zone = time.UTC
+	en := &EmailNotifier{}
+	_ = defaults.Set(en)
+	config["host"] = "127.0.0.1"
+	config["port"] = port
+	config["from"] = "alert@example.com"
+	if e := en.InjectConfig(config); e != nil {
+		t.Fatalf("InjectConfig error: %s", e)
+	}
+	return en
+}
+
+func testNotification() Notification {
+	return Notification{
+		Status:      Firing.String(),
+		Labels:      map[string]string{"alertname": "errors", "severity": "critical"},
+		Annotations: map[string]string{"summary": "too many errors"},
+		StartsAt:    time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Value:       "12",
+		Samples: []map[string]any{
+			{"message": "timeout", "status": 500},
+			{"message": "refused", "status": 502},
+		},
+	}
+}
+
+func receiveSession(t *testing.T, sessions <-chan smtpSession) smtpSession {
+	select {
+	case s := <-sessions:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("smtp session timeout")
+	}
+	return smtpSession{}
+}
+
+func TestEmailNotifierMessage(t *testing.T) {
+	port, sessions := startSMTPServer(t)
+	en := testEmailNotifier(t, port, map[string]any{
+		"tls":            EmailTLSNone,
+		"to":             []any{"ops@example.com"},
+		"cc":             []any{"dev@example.com"},
+		"attach_samples": EmailAttachNDJSON,
+	})
+	if e := en.Notify(testNotification()); e != nil {
+		t.Fatalf("Notify error: %s", e)
+	}
+	s := receiveSession(t, sessions)
+	if strings.Join(s.rcpts, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("recipients got: %v", s.rcpts)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(s.data)))
+	if err != nil {
+		t.Fatalf("ReadMessage error: %s", err)
+	}
+	if to := msg.Header.Get("To"); to != "ops@example.com" {
+		t.Errorf("To got: %s", to)
+	}
+	if cc := msg.Header.Get("Cc"); cc != "dev@example.com" {
+		t.Errorf("Cc got: %s", cc)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "[FIRING] errors" {
+		t.Errorf("Subject got: %s", subject)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type got: %s", mediaType)
+	}
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mixed.NextPart()
+	if err != nil {
+		t.Fatalf("body part error: %s", err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("body Content-Type got: %s", mediaType)
+	}
+	alternative := multipart.NewReader(part, params["boundary"])
+	for _, want := range []string{"text/plain", "text/html"} {
+		p, err := alternative.NextPart()
+		if err != nil {
+			t.Fatalf("%s part error: %s", want, err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(p)
+		if mediaType != want || !strings.Contains(string(body), "too many errors") {
+			t.Errorf("%s part got: %s %s", want, mediaType, body)
+		}
+	}
+
+	attachment, err := mixed.NextPart()
+	if err != nil {
+		t.Fatalf("attachment part error: %s", err)
+	}
+	if name := attachment.FileName(); name != "errors.ndjson" {
+		t.Errorf("attachment filename got: %s", name)
+	}
+	encoded, _ := io.ReadAll(attachment)
+	content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil {
+		t.Fatalf("attachment base64 error: %s", err)
+	}
+	want := "{\"message\":\"timeout\",\"status\":500}\n{\"message\":\"refused\",\"status\":502}\n"
+	if string(content) != want {
+		t.Errorf("attachment got: %s", content)
+	}
+	if _, err := mixed.NextPart(); err != io.EOF {
+		t.Errorf("unexpected part after the attachment: %v", err)
+	}
+}
+
+func TestEmailNotifierCcOnly(t *testing.T) {
+	port, sessions := startSMTPServer(t)
+	en := testEmailNotifier(t, port, map[string]any{
+		"tls": EmailTLSNone,
+		"cc":  []any{"dev@example.com"},
+	})
+	if e := en.Notify(testNotification()); e != nil {
+		t.Fatalf("Notify error: %s", e)
+	}
+	s := receiveSession(t, sessions)
+	msg, err := mail.ReadMessage(strings.NewReader(string(s.data)))
+	if err != nil {
+		t.Fatalf("ReadMessage error: %s", err)
+	}
+	if to := msg.Header.Get("To"); to != "undisclosed-recipients:;" {
+		t.Errorf("To got: %s", to)
+	}
+	if strings.Join(s.rcpts, ",") != "dev@example.com" {
+		t.Errorf("recipients got: %v", s.rcpts)
+	}
+}
+
+func TestEmailNotifierStartTLSRefused(t *testing.T) {
+	port, sessions := startSMTPServer(t, "8BITMIME")
+	en := testEmailNotifier(t, port, map[string]any{
+		"tls": EmailTLSStartTLS,
+		"to":  []any{"ops@example.com"},
+	})
+	e := en.Notify(testNotification())
+	if e == nil || !strings.Contains(e.Error(), "does not support STARTTLS") {
+		t.Fatalf("Notify error got: %v", e)
+	}
+	s := receiveSession(t, sessions)
+	for _, cmd := range s.commands {
+		if cmd == "MAIL" || cmd == "DATA" {
+			t.Errorf("mail sent in plaintext, commands: %v", s.commands)
+		}
+	}
+}
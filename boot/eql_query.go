@@ -0,0 +1,94 @@
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
+	"strings"
+	"time"
+)
+
+// runEQLQuery runs the rule EQL query. Event queries are matched by the rule type like documents,
+// every sequence of a sequence query is a candidate match. noData is set when the query returned no event.
+func (ea *ElasticAlert) runEQLQuery(r *conf.Rule, guard *ClusterGuard, f RuleType, start time.Time, end time.Time) ([]Match, bool, error) {
+	client := xelastic.NewElasticClient(r.ES, r.ES.Version)
+	if client == nil {
+		t := fmt.Sprintf("%s elasticsearch client is nil", r.UniqueId)
+		logger.Logger.Errorln(t)
+		return nil, false, errors.New("elasticsearch client is nil")
+	}
+	body := r.GetEQLBody(start, end)
+	indices := r.GetIndexNames(start, end)
+	guard.Acquire()
+	result, statusCode, err := client.QueryByEQL(indices, body)
+	guard.Release()
+	guard.Report(statusCode)
+	go ea.addQueryMetrics(r, statusCode)
+	if err != nil {
+		t := fmt.Sprintf("rule: %s eql query error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return nil, false, err
+	}
+	t := fmt.Sprintf("rules: %s index: %s eql: %s events_num: %d sequences_num: %d", r.FilePath, strings.Join(indices, ","), body, len(result.Events), len(result.Sequences))
+	logger.Logger.Debugln(t)
+	noData := len(result.Events) == 0 && len(result.Sequences) == 0
+	if len(result.Sequences) == 0 {
+		return toMatches(f.FilterMatchCondition(r, f.GetMatches(r, result.Events))), noData, nil
+	}
+	return toMatches(FilterSequenceMatchCondition(r, GetSequenceMatches(r, result.Sequences))), noData, nil
+}
+
+// GetSequenceMatches converts every EQL sequence into a match holding the ids of its events,
+// the match value is the number of events of the sequence.
+func GetSequenceMatches(r *conf.Rule, sequences [][]any) []Match {
+	matches := []Match{}
+	for _, events := range sequences {
+		match := Match{
+			r:          r,
+			Ids:        []string{},
+			HitsNumber: len(events),
+			Value:      float64(len(events)),
+		}
+		for i, item := range events {
+			m, _ := item.(map[string]any)
+			id, _ := m["_id"].(string)
+			match.Ids = append(match.Ids, id)
+			ts, _ := r.Timestamp.GetTime(m)
+			if i == 0 {
+				match.StartsAt = ts
+			}
+			match.EndsAt = ts
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// FilterSequenceMatchCondition matches once the number of sequences reaches num_events. The rule has a
+// single alert for all the sequences: the value is the number of sequences, the sample holds the events
+// of every sequence and the alert spans from the first to the last event.
+func FilterSequenceMatchCondition(r *conf.Rule, matches []Match) *Match {
+	if len(matches) == 0 || uint(len(matches)) < r.Query.Config.NumEvents {
+		return nil
+	}
+	match := &Match{
+		r:          r,
+		Ids:        []string{},
+		StartsAt:   matches[0].StartsAt,
+		EndsAt:     matches[0].EndsAt,
+		HitsNumber: len(matches),
+		Value:      float64(len(matches)),
+	}
+	for _, m := range matches {
+		match.Ids = append(match.Ids, m.Ids...)
+		if m.StartsAt.Before(match.StartsAt) {
+			match.StartsAt = m.StartsAt
+		}
+		if m.EndsAt.After(match.EndsAt) {
+			match.EndsAt = m.EndsAt
+		}
+	}
+	return match
+}
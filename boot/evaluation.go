@@ -0,0 +1,164 @@
+package boot
+
+import (
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+)
+
+const (
+	FailureQueryError = "query_error"
+	FailureNoData     = "no_data"
+
+	EvaluationFailedAlertName = "RuleEvaluationFailed"
+	NoDataAlertName           = "RuleNoData"
+)
+
+// EvaluationFailure is the reason of a dedicated alert sent by the on_error and on_no_data alert policy
+type EvaluationFailure struct {
+	Reason  string
+	Message string
+}
+
+func (ef *EvaluationFailure) AlertName() string {
+	if ef.Reason == FailureNoData {
+		return NoDataAlertName
+	}
+	return EvaluationFailedAlertName
+}
+
+// GetLabels returns the rule labels with the dedicated alertname, the rule id and the failure reason
+func (ef *EvaluationFailure) GetLabels(r *conf.Rule) map[string]string {
+	labels := map[string]string{}
+	for k, v := range r.Query.Labels {
+		labels[k] = v
+	}
+	if name, ok := labels["alertname"]; ok {
+		labels["rule_alertname"] = name
+	}
+	labels["alertname"] = ef.AlertName()
+	labels["unique_id"] = r.UniqueId
+	labels["reason"] = ef.Reason
+	return labels
+}
+
+func (ef *EvaluationFailure) GetAnnotations(r *conf.Rule) map[string]string {
+	summary := fmt.Sprintf("rule %s evaluation failed", r.FilePath)
+	if ef.Reason == FailureNoData {
+		summary = fmt.Sprintf("rule %s query returned no data", r.FilePath)
+	}
+	return map[string]string{
+		"summary":     summary,
+		"description": ef.Message,
+	}
+}
+
+func failureKey(uniqueId string, reason string) string {
+	return uniqueId + "/" + reason
+}
+
+// applyPolicy handles an evaluation which failed or returned no data with the on_error or on_no_data
+// policy of the rule, it returns true when the result is evaluated as usual.
+//   - keep_state: the rule alert keeps its state, a firing alert does not expire through keep_firing_for
+//   - alert: sends a dedicated alert for the reason, the rule alert keeps its state
+//   - resolve: the result is evaluated as usual, an active alert is resolved as the condition does not match
+//   - ignore: the evaluation is discarded as if it had not run
+func (ea *ElasticAlert) applyPolicy(r *conf.Rule, policy string, reason string, message string) bool {
+	switch policy {
+	case conf.PolicyResolve:
+		return true
+	case conf.PolicyIgnore:
+		return false
+	case conf.PolicyAlert:
+		ea.fireFailureAlert(r, reason, message)
+	}
+	ea.keepAlertState(r)
+	return false
+}
+
+func (ea *ElasticAlert) keepAlertState(r *conf.Rule) {
+	defer ea.lockRuleAlerts(r)()
+	now := xtime.Now()
+	for _, alert := range ea.getRuleAlerts(r) {
+		if alert.State != Firing {
+			continue
+		}
+		alert.LastMatchAt = now
+		ea.setAlert(alert)
+	}
+}
+
+func (ea *ElasticAlert) fireFailureAlert(r *conf.Rule, reason string, message string) {
+	key := failureKey(r.UniqueId, reason)
+	failure := &EvaluationFailure{Reason: reason, Message: message}
+	now := xtime.Now()
+	if v, ok := ea.failures.Load(key); ok {
+		alert := v.(AlertContent)
+		alert.Failure = failure
+		alert.LastMatchAt = now
+		alert.State = Firing
+		alert.EndsAt = nil
+		ea.failures.Store(key, alert)
+		return
+	}
+	t := fmt.Sprintf("rule: %s %s alert firing: %s", r.FilePath, failure.AlertName(), message)
+	logger.Logger.Warningln(t)
+	ea.failures.Store(key, AlertContent{
+		Rule:        r,
+		Match:       &Match{r: r, StartsAt: now, EndsAt: now},
+		StartsAt:    &now,
+		ActiveAt:    &now,
+		LastMatchAt: now,
+		State:       Firing,
+		Failure:     failure,
+	})
+}
+
+// resolveFailureAlert resolves the dedicated alert of the reason once the rule evaluation recovered
+func (ea *ElasticAlert) resolveFailureAlert(r *conf.Rule, reason string) {
+	key := failureKey(r.UniqueId, reason)
+	v, ok := ea.failures.Load(key)
+	if !ok {
+		return
+	}
+	alert := v.(AlertContent)
+	if alert.State != Firing {
+		return
+	}
+	endsAt := xtime.Now()
+	alert.EndsAt = &endsAt
+	alert.State = Resolved
+	ea.failures.Store(key, alert)
+}
+
+func (ea *ElasticAlert) deleteFailureAlerts(r *conf.Rule) {
+	ea.failures.Delete(failureKey(r.UniqueId, FailureQueryError))
+	ea.failures.Delete(failureKey(r.UniqueId, FailureNoData))
+}
+
+// pushFailureAlerts sends the dedicated alerts, they are throttled like the rule alerts. Unlike the
+// rule alerts they are only kept in memory, the next failed evaluation after a restart fires them again.
+func (ea *ElasticAlert) pushFailureAlerts() {
+	ea.failures.Range(func(key, value any) bool {
+		alert := value.(AlertContent)
+		if alert.HasResolved() {
+			if alert.SentAt != nil {
+				ea.publishAlert(alert)
+			}
+			ea.failures.Delete(key)
+			return true
+		}
+		sentAt := xtime.Now()
+		if !ea.claimAlertSend(alert, sentAt) {
+			return true
+		}
+		ea.publishAlert(alert)
+		if v, ok := ea.failures.Load(key); ok {
+			current := v.(AlertContent)
+			current.SentAt = &sentAt
+			ea.failures.Store(key, current)
+		}
+		return true
+	})
+}
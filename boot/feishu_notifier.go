@@ -0,0 +1,77 @@
+package boot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// FeishuNotifier sends interactive cards with markdown content to a Feishu/Lark custom bot, signed with the bot secret
+type FeishuNotifier struct {
+	WebhookUrl string `yaml:"webhook_url"`
+	Secret     string `yaml:"secret"`
+	Template   string `yaml:"template"`
+}
+
+// feishuColors are the font colors supported by the card markdown
+var feishuColors = map[string]string{
+	"firing":   "red",
+	"critical": "red",
+	"warning":  "orange",
+	"resolved": "green",
+}
+
+func (fn *FeishuNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, fn); e != nil {
+		return e
+	}
+	if fn.WebhookUrl == "" {
+		return errors.New("webhook_url is required")
+	}
+	return nil
+}
+
+func (fn *FeishuNotifier) Notify(n Notification) error {
+	content, e := renderMarkdown("feishu", fn.Template, n, feishuColors, func(color string, text string) string {
+		return fmt.Sprintf(`<font color='%s'>%s</font>`, color, text)
+	})
+	if e != nil {
+		return fmt.Errorf("feishu template error: %s", e.Error())
+	}
+	headerColor := "red"
+	if n.IsResolved() {
+		headerColor = "green"
+	}
+	msg := map[string]any{
+		"msg_type": "interactive",
+		"card": map[string]any{
+			"header": map[string]any{
+				"title":    map[string]any{"tag": "plain_text", "content": chatTitle(n)},
+				"template": headerColor,
+			},
+			"elements": []map[string]any{
+				{"tag": "markdown", "content": content},
+			},
+		},
+	}
+	if fn.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		msg["timestamp"] = timestamp
+		msg["sign"] = fn.sign(timestamp)
+	}
+	body, e := postNotifyJSON(fn.WebhookUrl, msg, nil)
+	if e != nil {
+		return e
+	}
+	return checkBotResponse(body)
+}
+
+// sign is the base64 hmac-sha256 of an empty message keyed by the timestamp and the secret
+func (fn *FeishuNotifier) sign(timestamp string) string {
+	h := hmac.New(sha256.New, []byte(timestamp+"\n"+fn.Secret))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -113,6 +113,22 @@ func (fl *FileLoader) ReloadSchedulerJob(engine *ElasticAlert) {
 func (fl *FileLoader) handleDirChange(path string, engine *ElasticAlert) {
 	logger.Logger.Infoln("Listen file watcher dir: " + path)
 	FsWatcher(path, func(event *fsnotify.Event, e error) {
+		if event == nil {
+			return
+		}
+		if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+			oldPath := event.Name
+			// Editors replace the file on save, a file created again is reloaded by its create event
+			if ok, _ := utils.PathExists(oldPath); ok || !strings.HasSuffix(oldPath, RuleFileSuffix) {
+				return
+			}
+			for _, oldRule := range engine.getRulesByPath(oldPath) {
+				t := fmt.Sprintf("REMOVE %s success!", oldPath)
+				logger.Logger.Infoln(t)
+				engine.removeJobScheduler(oldRule)
+			}
+			return
+		}
 		if event.Has(fsnotify.Create) {
 			newPath := event.Name
 			if ok, _ := utils.PathExists(newPath); !ok {
@@ -139,8 +155,7 @@ func (fl *FileLoader) handleDirChange(path string, engine *ElasticAlert) {
 			for _, newRule := range rules {
 				p := newRule.FilePath
 				engine.rules.Store(newRule.UniqueId, newRule)
-				_, ok := engine.schedulers.Load(newRule.UniqueId)
-				if ok {
+				if engine.scheduler.Has(newRule.UniqueId) {
 					t := fmt.Sprintf("RELOAD %s success!", p)
 					logger.Logger.Infoln(t)
 					engine.restartJobScheduler(newRule)
@@ -164,6 +179,12 @@ func (fl *FileLoader) handleFileChange(filePath string, engine *ElasticAlert) {
 				t := fmt.Sprintf("RELOAD %s failed reason: %s", filePath, e.Error())
 				logger.Logger.Warningln(t)
 			} else {
+				// A rule whose unique_id changed is removed under its previous id
+				for _, oldRule := range engine.getRulesByPath(filePath) {
+					if oldRule.UniqueId != newRule.UniqueId {
+						engine.removeJobScheduler(oldRule)
+					}
+				}
 				engine.rules.Store(newRule.UniqueId, newRule)
 				engine.restartJobScheduler(newRule)
 				t := fmt.Sprintf("RELOAD %s success!", filePath)
@@ -175,7 +196,7 @@ func (fl *FileLoader) handleFileChange(filePath string, engine *ElasticAlert) {
 
 func (fl *FileLoader) getSingleRule(path string) (*conf.Rule, error) {
 	rule := conf.Rule{}
-	_ = defaults.Set(rule)
+	_ = defaults.Set(&rule)
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -194,6 +215,13 @@ func (fl *FileLoader) getSingleRule(path string) (*conf.Rule, error) {
 			return nil, errors.New(errorMsg)
 		}
 		e = yaml.Unmarshal(content, &rule)
+		if e != nil {
+			return nil, e
+		}
+		e = rule.CompileQuery()
+		if e == nil && conf.AppConf != nil {
+			e = rule.ValidateNotifiers(conf.AppConf)
+		}
 		if e != nil {
 			return nil, e
 		} else {
@@ -0,0 +1,204 @@
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+// FlapState tracks the state transitions of a rule alert. The alert transitions (firing, resolved) are
+// counted while it is not flapping, then the condition changes are counted while the alert is held firing.
+type FlapState struct {
+	lock           sync.Mutex
+	transitions    []time.Time
+	lastTransition time.Time
+	matched        bool
+	flapping       bool
+	// saved is the state last saved to redis
+	saved string
+}
+
+// PersistedFlapState is the flapping state saved in redis, one hash field per alert keyed by the alert key,
+// so that the transitions counted before a restart still count
+type PersistedFlapState struct {
+	Transitions    []time.Time `json:"transitions"`
+	LastTransition time.Time   `json:"last_transition"`
+	Matched        bool        `json:"matched"`
+	Flapping       bool        `json:"flapping"`
+}
+
+func NewFlapState(ps PersistedFlapState) *FlapState {
+	return &FlapState{
+		transitions:    ps.Transitions,
+		lastTransition: ps.LastTransition,
+		matched:        ps.Matched,
+		flapping:       ps.Flapping,
+	}
+}
+
+// Persisted returns the state to save, idle is set when no transition within the window is left to remember
+func (fs *FlapState) Persisted(c conf.FlappingConfig, now time.Time) (PersistedFlapState, bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	ps := PersistedFlapState{
+		Transitions:    fs.transitions,
+		LastTransition: fs.lastTransition,
+		Matched:        fs.matched,
+		Flapping:       fs.flapping,
+	}
+	idle := !fs.flapping
+	for _, t := range fs.transitions {
+		if t.After(now.Add(-c.GetWindow())) {
+			idle = false
+		}
+	}
+	return ps, idle
+}
+
+// Record adds a transition at now, the alert starts flapping once the transitions within the window reach the limit
+func (fs *FlapState) Record(c conf.FlappingConfig, now time.Time) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	start := now.Add(-c.GetWindow())
+	transitions := []time.Time{}
+	for _, t := range fs.transitions {
+		if t.After(start) {
+			transitions = append(transitions, t)
+		}
+	}
+	fs.transitions = append(transitions, now)
+	fs.lastTransition = now
+	if !fs.flapping && uint(len(fs.transitions)) >= c.MaxTransitions {
+		fs.flapping = true
+		return true
+	}
+	return false
+}
+
+// Observe records the condition of an evaluation and returns whether it changed since the previous one
+func (fs *FlapState) Observe(matched bool) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	changed := fs.matched != matched
+	fs.matched = matched
+	return changed
+}
+
+// Update ends flapping once no transition happened for stable_for
+func (fs *FlapState) Update(c conf.FlappingConfig, now time.Time) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.flapping && now.Sub(fs.lastTransition) >= c.GetStableFor() {
+		fs.flapping = false
+		fs.transitions = []time.Time{}
+	}
+	return fs.flapping
+}
+
+func (fs *FlapState) IsFlapping() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.flapping
+}
+
+// getFlapState returns the flapping state of an alert, key is the alert key. The state is loaded from
+// redis on the first use after a start or a reload.
+func (ea *ElasticAlert) getFlapState(r *conf.Rule, key string) *FlapState {
+	v, ok := ea.flaps.Load(key)
+	if !ok {
+		v, _ = ea.flaps.LoadOrStore(key, ea.loadFlapState(r, key))
+	}
+	return v.(*FlapState)
+}
+
+func (ea *ElasticAlert) loadFlapState(r *conf.Rule, key string) *FlapState {
+	val, err := redisx.Client.HGet(ctx, redisx.FlapStateHashKey, key).Result()
+	if err == redis.Nil {
+		return &FlapState{}
+	}
+	if err != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hget", redisx.FlapStateHashKey, 0)
+		t := fmt.Sprintf("rule: %s load flapping state error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return &FlapState{}
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "hget", redisx.FlapStateHashKey, 1)
+	var ps PersistedFlapState
+	if e := json.Unmarshal([]byte(val), &ps); e != nil {
+		t := fmt.Sprintf("rule: %s flapping state json.Unmarshal error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return &FlapState{}
+	}
+	fs := NewFlapState(ps)
+	fs.saved = val
+	return fs
+}
+
+// saveFlapState saves the flapping state when it changed, the idle states are deleted
+func (ea *ElasticAlert) saveFlapState(r *conf.Rule, key string, fs *FlapState, now time.Time) {
+	ps, idle := fs.Persisted(r.Flapping, now)
+	val := ""
+	if !idle {
+		bs, _ := json.Marshal(ps)
+		val = string(bs)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if val == fs.saved {
+		return
+	}
+	op := "hset"
+	var err error
+	if idle {
+		op = "hdel"
+		err = redisx.Client.HDel(ctx, redisx.FlapStateHashKey, key).Err()
+	} else {
+		err = redisx.Client.HSet(ctx, redisx.FlapStateHashKey, key, val).Err()
+	}
+	if err != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, op, redisx.FlapStateHashKey, 0)
+		t := fmt.Sprintf("rule: %s save flapping state error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, op, redisx.FlapStateHashKey, 1)
+	fs.saved = val
+}
+
+// observeFlapping is called for every evaluation of an alert, it returns whether the alert is flapping
+func (ea *ElasticAlert) observeFlapping(r *conf.Rule, key string, matched bool, now time.Time) bool {
+	if !r.Flapping.Enabled() {
+		return false
+	}
+	fs := ea.getFlapState(r, key)
+	if fs.Observe(matched) && fs.IsFlapping() {
+		fs.Record(r.Flapping, now)
+	}
+	flapping := fs.Update(r.Flapping, now)
+	ea.saveFlapState(r, key, fs, now)
+	return flapping
+}
+
+// recordFlappingTransition is called when an alert starts firing or is resolved
+func (ea *ElasticAlert) recordFlappingTransition(r *conf.Rule, key string, now time.Time) bool {
+	if !r.Flapping.Enabled() {
+		return false
+	}
+	fs := ea.getFlapState(r, key)
+	if fs.IsFlapping() {
+		return true
+	}
+	flapping := fs.Record(r.Flapping, now)
+	ea.saveFlapState(r, key, fs, now)
+	if flapping {
+		t := fmt.Sprintf("rule: %s alert is flapping, held firing until stable for %s", r.FilePath, r.Flapping.GetStableFor())
+		logger.Logger.Warningln(t)
+		return true
+	}
+	return false
+}
@@ -2,9 +2,7 @@ package boot
 
 import (
 	"encoding/json"
-	"github.com/dream-mo/prom-elastic-alert/conf"
 	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
-	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
 	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
 	"html/template"
 	"net/http"
@@ -32,17 +30,19 @@ func RenderAlertMessage(writer http.ResponseWriter, request *http.Request) {
 						return string(res)
 					},
 					"showTime": func(v map[string]any) string {
-						m := v["_source"].(map[string]any)
-						return xtime.TimeFormatISO8601(xtime.Parse(m["@timestamp"].(string)))
+						ts, ok := message.Timestamp.GetTime(v)
+						if !ok {
+							return ""
+						}
+						return xtime.TimeFormatISO8601(ts)
 					},
 				}).Parse(htmlPage)
-				body := conf.BuildFindByIdsDSLBody(message.Ids)
-				client := xelastic.NewElasticClient(message.ES, message.ES.Version)
-				hits, _, _ := client.FindByDSL(message.Index, body, nil)
+				hits := message.GetHits()
 				hitsStr, _ := json.Marshal(hits)
 				_ = t.Execute(writer, map[string]any{
-					"hitsStr": string(hitsStr),
-					"hits":    hits,
+					"hitsStr":        string(hitsStr),
+					"hits":           hits,
+					"timestampField": message.Timestamp.GetField(),
 				})
 			}
 		}
@@ -83,7 +83,7 @@ var htmlPage = `
         </colgroup>
         <thead>
         <tr>
-            <th>@timestamp</th>
+            <th>{{.timestampField}}</th>
             <th>内容</th>
             <th style="text-align: center">操作</th>
         </tr>
@@ -0,0 +1,72 @@
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// defaultMarkdownTemplate is the markdown message of the DingTalk, WeCom and Feishu notifiers, it shows the
+// same content as example/prom-alert/DingTalk-Template.tpl. color wraps a text with the color of a level:
+// firing, resolved or the severity label (warning, critical).
+var defaultMarkdownTemplate = `{{if .IsResolved}}## [告警恢复-通知]({{.GeneratorURL}})
+{{else}}## [监控告警-通知]({{.GeneratorURL}})
+{{end}}#### 监控指标: {{.Labels.alertname}}
+{{if .Labels.severity}}#### 告警级别: **{{color .Labels.severity .Labels.severity}}**
+{{end}}{{if .IsResolved}}#### 当前状态: **{{color "resolved" "已恢复"}}**
+{{else if eq .Labels.severity "critical"}}#### 当前状态: **{{color "critical" "需要处理"}}**
+{{else}}#### 当前状态: **{{color "warning" "需要关注"}}**
+{{end}}{{if .Labels.ipaddr}}#### 故障主机: {{.Labels.ipaddr}}
+#### 故障业务: {{.Labels.instance}}
+{{else if .Labels.instance}}#### 故障主机: {{.Labels.instance}}
+{{end}}{{if .Labels.threshold}}- 告警阈值: {{.Labels.threshold}}
+{{end}}- 告警数量: {{.Value}}
+{{if .IsResolved}}- 开始时间: {{formatTime .StartsAt}}
+- 恢复时间: {{formatTime .EndsAt}}
+
+#### 告警恢复: {{color "resolved" (printf "已恢复,%s" .Annotations.description)}}
+{{else}}{{if .Labels.for_time}}- 持续时间: {{.Labels.for_time}}
+{{end}}- 触发时间: {{formatTime .StartsAt}}
+
+#### 告警触发: {{color .Labels.severity .Annotations.description}}
+{{end}}`
+
+// renderMarkdown renders the markdown template, the default template when tpl is empty.
+// format returns the text wrapped with a color of the colors map, the text is kept as is without color.
+func renderMarkdown(name string, tpl string, n Notification, colors map[string]string, format func(color string, text string) string) (string, error) {
+	if tpl == "" {
+		tpl = defaultMarkdownTemplate
+	}
+	return renderNotifierTemplate(name, tpl, n, template.FuncMap{
+		"color": func(level string, text string) string {
+			c, ok := colors[level]
+			if !ok {
+				c = colors["firing"]
+			}
+			if c == "" {
+				return text
+			}
+			return format(c, text)
+		},
+	})
+}
+
+// checkBotResponse checks the error code of the chat robot apis, which answer 200 on errors
+func checkBotResponse(body []byte) error {
+	var res struct {
+		ErrCode *int   `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+		Code    *int   `json:"code"`
+		Msg     string `json:"msg"`
+	}
+	if e := json.Unmarshal(body, &res); e != nil {
+		return e
+	}
+	if res.ErrCode != nil && *res.ErrCode != 0 {
+		return fmt.Errorf("errcode: %d errmsg: %s", *res.ErrCode, res.ErrMsg)
+	}
+	if res.Code != nil && *res.Code != 0 {
+		return fmt.Errorf("code: %d msg: %s", *res.Code, res.Msg)
+	}
+	return nil
+}
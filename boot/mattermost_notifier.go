@@ -0,0 +1,60 @@
+package boot
+
+import (
+	"errors"
+)
+
+// MattermostNotifier sends message attachments to a Mattermost incoming webhook
+type MattermostNotifier struct {
+	WebhookUrl    string `yaml:"webhook_url"`
+	Channel       string `yaml:"channel"`
+	Username      string `yaml:"username"`
+	IconUrl       string `yaml:"icon_url"`
+	FiringColor   string `yaml:"firing_color" default:"#E01E5A"`
+	ResolvedColor string `yaml:"resolved_color" default:"#2EB67D"`
+}
+
+func (mn *MattermostNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, mn); e != nil {
+		return e
+	}
+	if mn.WebhookUrl == "" {
+		return errors.New("webhook_url is required")
+	}
+	return nil
+}
+
+func (mn *MattermostNotifier) Notify(n Notification) error {
+	_, e := postNotifyJSON(mn.WebhookUrl, mn.getMessage(n), nil)
+	return e
+}
+
+func (mn *MattermostNotifier) getMessage(n Notification) map[string]any {
+	fields := []map[string]any{}
+	for _, f := range chatFields(n) {
+		fields = append(fields, map[string]any{"short": true, "title": f.Title, "value": f.Value})
+	}
+	title := chatTitle(n)
+	msg := map[string]any{
+		"attachments": []map[string]any{
+			{
+				"fallback":   title,
+				"color":      chatColor(n, mn.FiringColor, mn.ResolvedColor),
+				"title":      title,
+				"title_link": n.GeneratorURL,
+				"text":       chatText(n),
+				"fields":     fields,
+			},
+		},
+	}
+	if mn.Channel != "" {
+		msg["channel"] = mn.Channel
+	}
+	if mn.Username != "" {
+		msg["username"] = mn.Username
+	}
+	if mn.IconUrl != "" {
+		msg["icon_url"] = mn.IconUrl
+	}
+	return msg
+}
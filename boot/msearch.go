@@ -0,0 +1,163 @@
+package boot
+
+import (
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultMSearchMaxBatchSize = 50
+
+type msearchRequest struct {
+	item   xelastic.MultiSearchItem
+	result chan xelastic.SearchResult
+}
+
+// MSearchBatcher collects the count and search requests of the rules evaluated at about the same time
+// against one elasticsearch cluster, and sends them as a single _msearch request. The responses are
+// handed back to every waiting rule evaluation in the request order.
+type MSearchBatcher struct {
+	EsAddress string
+	client    xelastic.ElasticClient
+	guard     *ClusterGuard
+	queue     chan *msearchRequest
+	stop      chan struct{}
+	maxSize   int
+	window    time.Duration
+
+	lock          sync.Mutex
+	batches       uint64
+	searches      uint64
+	durationTotal float64
+}
+
+// Search queues the item into the next batch and waits for its result
+func (mb *MSearchBatcher) Search(item xelastic.MultiSearchItem) xelastic.SearchResult {
+	req := &msearchRequest{
+		item:   item,
+		result: make(chan xelastic.SearchResult, 1),
+	}
+	select {
+	case mb.queue <- req:
+		return <-req.result
+	case <-mb.stop:
+		return xelastic.SearchResult{Hits: []any{}, StatusCode: xelastic.HttpTransportErrorCode}
+	}
+}
+
+func (mb *MSearchBatcher) run() {
+	for {
+		var first *msearchRequest
+		select {
+		case first = <-mb.queue:
+		case <-mb.stop:
+			return
+		}
+		batch := []*msearchRequest{first}
+		timer := time.NewTimer(mb.window)
+	collect:
+		for len(batch) < mb.maxSize {
+			select {
+			case req := <-mb.queue:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			case <-mb.stop:
+				break collect
+			}
+		}
+		timer.Stop()
+		go mb.flush(batch)
+	}
+}
+
+func (mb *MSearchBatcher) flush(batch []*msearchRequest) {
+	items := make([]xelastic.MultiSearchItem, len(batch))
+	for i, req := range batch {
+		items[i] = req.item
+	}
+	begin := time.Now()
+	// Every search of the batch takes a slot, elasticsearch runs the batch within the acquired slots
+	slots := mb.guard.AcquireN(len(items))
+	results, statusCode := mb.client.MultiSearch(items, slots)
+	mb.guard.ReleaseN(slots)
+	duration := time.Since(begin)
+	if statusCode != http.StatusOK {
+		mb.guard.Report(statusCode)
+	} else {
+		// A successful _msearch may hold failed searches, each one is reported to the circuit breaker
+		for _, result := range results {
+			mb.guard.Report(result.StatusCode)
+		}
+	}
+	mb.lock.Lock()
+	mb.batches++
+	mb.searches += uint64(len(batch))
+	mb.durationTotal += duration.Seconds()
+	mb.lock.Unlock()
+	t := fmt.Sprintf("msearch es_address: %s batch_size: %d status: %d took: %s", mb.EsAddress, len(batch), statusCode, duration)
+	logger.Logger.Debugln(t)
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
+
+// Stats returns the number of _msearch requests, the number of searches sent within them and the total duration in seconds
+func (mb *MSearchBatcher) Stats() (uint64, uint64, float64) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return mb.batches, mb.searches, mb.durationTotal
+}
+
+func (mb *MSearchBatcher) Stop() {
+	close(mb.stop)
+}
+
+func NewMSearchBatcher(r *conf.Rule, guard *ClusterGuard, c *conf.AppConfig) *MSearchBatcher {
+	client := xelastic.NewElasticClient(r.ES, r.ES.Version)
+	if client == nil {
+		return nil
+	}
+	ms := c.Elasticsearch.MSearch
+	maxSize := int(ms.MaxBatchSize)
+	if maxSize == 0 {
+		maxSize = defaultMSearchMaxBatchSize
+	}
+	mb := &MSearchBatcher{
+		EsAddress: guard.EsAddress,
+		client:    client,
+		guard:     guard,
+		queue:     make(chan *msearchRequest),
+		stop:      make(chan struct{}),
+		maxSize:   maxSize,
+		window:    time.Millisecond * time.Duration(ms.BatchWindowMs),
+	}
+	go mb.run()
+	return mb
+}
+
+// getMSearchBatcher returns the batcher of the rule cluster, nil when _msearch batching is disabled.
+// Rules using different credentials on the same cluster are batched separately.
+func (ea *ElasticAlert) getMSearchBatcher(r *conf.Rule, guard *ClusterGuard) *MSearchBatcher {
+	if !ea.appConf.Elasticsearch.MSearch.Enabled {
+		return nil
+	}
+	key := r.GetEsAddress() + "|" + r.ES.Version + "|" + r.ES.Username
+	b, ok := ea.batchers.Load(key)
+	if !ok {
+		mb := NewMSearchBatcher(r, guard, ea.appConf)
+		if mb == nil {
+			return nil
+		}
+		var loaded bool
+		b, loaded = ea.batchers.LoadOrStore(key, mb)
+		if loaded {
+			mb.Stop()
+		}
+	}
+	return b.(*MSearchBatcher)
+}
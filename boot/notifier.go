@@ -0,0 +1,220 @@
+package boot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/creasty/defaults"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/http"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+const (
+	NotifyStatusSuccess = "success"
+	NotifyStatusFailure = "failure"
+	NotifyRetryTimes    = 3
+)
+
+// Notifier delivers the alerts to a destination, a new instance is created for every notification
+// with the notifier config merged with the rule config
+type Notifier interface {
+	InjectConfig(config map[string]any) error
+	Notify(n Notification) error
+}
+
+// Notification is the alert delivered to the notifiers
+type Notification struct {
+	UniqueId     string            `json:"unique_id"`
+	Path         string            `json:"path"`
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"starts_at"`
+	EndsAt       *time.Time        `json:"ends_at,omitempty"`
+	GeneratorURL string            `json:"generator_url"`
+	Value        string            `json:"value"`
+	HitsNumber   int               `json:"hits_number"`
+	// WindowStart and WindowEnd are the time range of the matched documents
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	CatchUp     bool      `json:"catch_up,omitempty"`
+	// Samples are the _source of the sample documents, only loaded for the notifiers implementing SampleNotifier
+	Samples []map[string]any `json:"samples,omitempty"`
+}
+
+// SampleNotifier is implemented by the notifiers rendering the sample documents, at most SampleLimit are loaded
+type SampleNotifier interface {
+	SampleLimit() int
+}
+
+func (n Notification) IsResolved() bool {
+	return n.Status == Resolved.String()
+}
+
+var (
+	notifierTypes      map[string]reflect.Type
+	notifierHttpClient = &http.Client{Timeout: time.Second * 10}
+)
+
+func NewNotifierInstance(t string) (Notifier, error) {
+	T, ok := notifierTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("notifier type %s not exists", t)
+	}
+	v := reflect.New(T)
+	i := v.Interface()
+	instance := i.(Notifier)
+	_ = defaults.Set(instance)
+	return instance, nil
+}
+
+// decodeNotifierConfig decodes the notifier config map into the notifier yaml fields
+func decodeNotifierConfig(config map[string]any, v any) error {
+	bs, e := yaml.Marshal(config)
+	if e != nil {
+		return e
+	}
+	return yaml.Unmarshal(bs, v)
+}
+
+// getNotifier returns the rule notifier and its type
+func (ea *ElasticAlert) getNotifier(rn conf.RuleNotifier) (Notifier, string, error) {
+	nc, ok := ea.appConf.GetNotifiers()[rn.Name]
+	if !ok {
+		return nil, "", fmt.Errorf("notifier %s is not declared", rn.Name)
+	}
+	n, e := NewNotifierInstance(nc.Type)
+	if e != nil {
+		return nil, nc.Type, e
+	}
+	if e := n.InjectConfig(rn.MergeConfig(nc)); e != nil {
+		return nil, nc.Type, fmt.Errorf("notifier %s config error: %s", rn.Name, e.Error())
+	}
+	return n, nc.Type, nil
+}
+
+// getMessageNotifiers returns the notifiers of a queued message with their rule config. The messages queued
+// without notifiers, by the versions before the notifiers, are sent to the default notifiers.
+func (ea *ElasticAlert) getMessageNotifiers(message AlertMessage) []conf.RuleNotifier {
+	if len(message.Notifiers) == 0 {
+		return ea.appConf.GetDefaultNotifiers()
+	}
+	var ruleNotifiers []conf.RuleNotifier
+	if v, ok := ea.rules.Load(message.UniqueId); ok {
+		ruleNotifiers = v.(*conf.Rule).Notifiers
+	}
+	notifiers := make([]conf.RuleNotifier, 0, len(message.Notifiers))
+	for _, name := range message.Notifiers {
+		rn := conf.RuleNotifier{Name: name}
+		for _, n := range ruleNotifiers {
+			if n.Name == name {
+				rn = n
+				break
+			}
+		}
+		notifiers = append(notifiers, rn)
+	}
+	return notifiers
+}
+
+// validateNotifiers checks the type and the config of the declared notifiers
+func (ea *ElasticAlert) validateNotifiers() []error {
+	errs := []error{}
+	for name := range ea.appConf.GetNotifiers() {
+		if _, _, e := ea.getNotifier(conf.RuleNotifier{Name: name}); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// loadSamples returns the _source of at most limit sample documents of the alert message
+func (ea *ElasticAlert) loadSamples(message AlertMessage, limit int) []map[string]any {
+	samples := []map[string]any{}
+	if message.SampleKey == "" || limit <= 0 {
+		return samples
+	}
+	val, err := redisx.Client.Get(ctx, message.SampleKey).Result()
+	if err != nil {
+		t := fmt.Sprintf("rule: %s load sample documents error: %s", message.Path, err.Error())
+		logger.Logger.Warningln(t)
+		return samples
+	}
+	var sample AlertSampleMessage
+	if e := json.Unmarshal([]byte(val), &sample); e != nil {
+		return samples
+	}
+	for _, hit := range sample.GetHits() {
+		if len(samples) >= limit {
+			break
+		}
+		m, _ := hit.(map[string]any)
+		if source, ok := m["_source"].(map[string]any); ok {
+			samples = append(samples, source)
+		}
+	}
+	return samples
+}
+
+var notifierFuncs = template.FuncMap{
+	"json": func(v any) string {
+		res, _ := json.Marshal(v)
+		return string(res)
+	},
+	"formatTime": func(t time.Time) string {
+		return xtime.TimeFormatISO8601(t)
+	},
+}
+
+// renderNotifierTemplate renders a notifier template with the notification, funcs are added to the template functions
+func renderNotifierTemplate(name string, tpl string, n Notification, funcs ...template.FuncMap) (string, error) {
+	t := template.New(name).Funcs(notifierFuncs)
+	for _, f := range funcs {
+		t = t.Funcs(f)
+	}
+	t, e := t.Parse(tpl)
+	if e != nil {
+		return "", e
+	}
+	bf := bytes.NewBufferString("")
+	if e := t.Execute(bf, n); e != nil {
+		return "", e
+	}
+	return bf.String(), nil
+}
+
+// doNotifyRequest sends the request of a http notifier, a response status out of 2xx is an error
+func doNotifyRequest(req *http.Request) ([]byte, error) {
+	resp, e := notifierHttpClient.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return body, fmt.Errorf("response status: %d body: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+func init() {
+	notifierTypes = map[string]reflect.Type{
+		conf.AlertmanagerNotifierType: reflect.TypeOf(AlertmanagerNotifier{}),
+		"webhook":                     reflect.TypeOf(WebhookNotifier{}),
+		"slack":                       reflect.TypeOf(SlackNotifier{}),
+		"teams":                       reflect.TypeOf(TeamsNotifier{}),
+		"mattermost":                  reflect.TypeOf(MattermostNotifier{}),
+		"dingtalk":                    reflect.TypeOf(DingTalkNotifier{}),
+		"wecom":                       reflect.TypeOf(WeComNotifier{}),
+		"feishu":                      reflect.TypeOf(FeishuNotifier{}),
+		"email":                       reflect.TypeOf(EmailNotifier{}),
+	}
+}
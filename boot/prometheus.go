@@ -12,16 +12,22 @@ import (
 )
 
 type ElasticAlertPrometheusMetrics struct {
-	Query         sync.Map // map[string]QueryMetrics
-	OpRedis       sync.Map // map[string]OpRedisMetrics
-	WebhookNotify sync.Map // map[string]WebhookNotifyMetrics
+	Query           sync.Map // map[string]QueryMetrics
+	OpRedis         sync.Map // map[string]OpRedisMetrics
+	Notify          sync.Map // map[string]NotifyMetrics
+	Skipped         sync.Map // map[string]SkippedMetrics
+	IncompleteQuery sync.Map // map[string]IncompleteQueryMetrics
+	IngestLag       sync.Map // map[string]IngestLagMetrics
 }
 
 func NewElasticAlertPrometheusMetrics() *ElasticAlertPrometheusMetrics {
 	return &ElasticAlertPrometheusMetrics{
-		Query:         sync.Map{},
-		OpRedis:       sync.Map{},
-		WebhookNotify: sync.Map{},
+		Query:           sync.Map{},
+		OpRedis:         sync.Map{},
+		Notify:          sync.Map{},
+		Skipped:         sync.Map{},
+		IncompleteQuery: sync.Map{},
+		IngestLag:       sync.Map{},
 	}
 }
 
@@ -43,21 +49,73 @@ type QueryMetrics struct {
 	Value     int64
 }
 
-type WebhookNotifyMetrics struct {
+type NotifyMetrics struct {
 	UniqueId string
 	Path     string
-	Status   int
+	Notifier string
+	Type     string
+	Status   string
 	Value    int64
 }
 
+const (
+	IncompleteTimedOut = "timed_out"
+	IncompletePartial  = "partial"
+)
+
+type IncompleteQueryMetrics struct {
+	UniqueId  string
+	Path      string
+	EsAddress string
+	Index     string
+	Reason    string
+	Value     int64
+}
+
+const (
+	IngestLagMax = "max"
+	IngestLagAvg = "avg"
+)
+
+// IngestLagMetrics is a gauge of the documents fetched by the last evaluation
+type IngestLagMetrics struct {
+	UniqueId string
+	Path     string
+	Index    string
+	Stat     string
+	Value    float64
+}
+
+type SkippedMetrics struct {
+	UniqueId  string
+	Path      string
+	EsAddress string
+	Reason    string
+	Value     int64
+}
+
 type RuleStatusCollector struct {
-	Ea                *ElasticAlert
-	AppInfoDesc       *prometheus.Desc
-	RuleStatusDesc    *prometheus.Desc
-	LinkRedisDesc     *prometheus.Desc
-	QueryDesc         *prometheus.Desc
-	OpRedisDesc       *prometheus.Desc
-	WebhookNotifyDesc *prometheus.Desc
+	Ea                 *ElasticAlert
+	AppInfoDesc        *prometheus.Desc
+	RuleStatusDesc     *prometheus.Desc
+	LinkRedisDesc      *prometheus.Desc
+	QueryDesc          *prometheus.Desc
+	OpRedisDesc        *prometheus.Desc
+	NotifyDesc         *prometheus.Desc
+	SkippedDesc        *prometheus.Desc
+	IncompleteDesc     *prometheus.Desc
+	CircuitBreakerDesc *prometheus.Desc
+	InFlightDesc       *prometheus.Desc
+	IngestLagDesc      *prometheus.Desc
+	NextRunDesc        *prometheus.Desc
+	AlertsDesc         *prometheus.Desc
+	FlappingDesc       *prometheus.Desc
+	EvalDurationDesc   *prometheus.Desc
+	QueueDepthDesc     *prometheus.Desc
+	BusyWorkersDesc    *prometheus.Desc
+	SchedulingLagDesc  *prometheus.Desc
+	MSearchBatchDesc   *prometheus.Desc
+	MSearchLatencyDesc *prometheus.Desc
 }
 
 func (rc *RuleStatusCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -66,18 +124,98 @@ func (rc *RuleStatusCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- rc.LinkRedisDesc
 	ch <- rc.QueryDesc
 	ch <- rc.OpRedisDesc
-	ch <- rc.WebhookNotifyDesc
+	ch <- rc.NotifyDesc
+	ch <- rc.SkippedDesc
+	ch <- rc.IncompleteDesc
+	ch <- rc.CircuitBreakerDesc
+	ch <- rc.InFlightDesc
+	ch <- rc.IngestLagDesc
+	ch <- rc.NextRunDesc
+	ch <- rc.AlertsDesc
+	ch <- rc.FlappingDesc
+	ch <- rc.EvalDurationDesc
+	ch <- rc.QueueDepthDesc
+	ch <- rc.BusyWorkersDesc
+	ch <- rc.SchedulingLagDesc
+	ch <- rc.MSearchBatchDesc
+	ch <- rc.MSearchLatencyDesc
 }
 
 func (rc *RuleStatusCollector) Collect(ch chan<- prometheus.Metric) {
 	rc.collectAppInfo(ch)
 	rc.collectLinkRedisStatus(ch)
+	rc.collectClusterMetrics(ch)
+	rc.collectMSearchMetrics(ch)
+	rc.collectSchedulerMetrics(ch)
+	rc.collectAlerts(ch)
 	rc.Ea.rules.Range(func(key, value any) bool {
 		rule := value.(*conf.Rule)
 		rc.collectRuleStatus(ch, rule)
+		rc.collectSchedule(ch, rule)
 		rc.collectQueryMetrics(ch, rule)
 		rc.collectOpRedisMetrics(ch, rule)
-		rc.collectWebhookNotifyMetrics(ch, rule)
+		rc.collectNotifyMetrics(ch, rule)
+		rc.collectSkippedMetrics(ch, rule)
+		rc.collectIncompleteQueryMetrics(ch, rule)
+		rc.collectIngestLagMetrics(ch, rule)
+		return true
+	})
+}
+
+func (rc *RuleStatusCollector) collectSkippedMetrics(ch chan<- prometheus.Metric, rule *conf.Rule) {
+	val, ok := rc.Ea.metrics.Load(rule.UniqueId)
+	if ok {
+		m := val.(*ElasticAlertPrometheusMetrics)
+		m.Skipped.Range(func(key, value any) bool {
+			v := value.(SkippedMetrics)
+			labelValues := []string{v.UniqueId, v.Path, v.EsAddress, v.Reason}
+			ch <- prometheus.MustNewConstMetric(rc.SkippedDesc, prometheus.CounterValue, float64(v.Value), labelValues...)
+			return true
+		})
+	}
+}
+
+func (rc *RuleStatusCollector) collectIncompleteQueryMetrics(ch chan<- prometheus.Metric, rule *conf.Rule) {
+	val, ok := rc.Ea.metrics.Load(rule.UniqueId)
+	if ok {
+		m := val.(*ElasticAlertPrometheusMetrics)
+		m.IncompleteQuery.Range(func(key, value any) bool {
+			v := value.(IncompleteQueryMetrics)
+			labelValues := []string{v.UniqueId, v.Path, v.EsAddress, v.Index, v.Reason}
+			ch <- prometheus.MustNewConstMetric(rc.IncompleteDesc, prometheus.CounterValue, float64(v.Value), labelValues...)
+			return true
+		})
+	}
+}
+
+func (rc *RuleStatusCollector) collectIngestLagMetrics(ch chan<- prometheus.Metric, rule *conf.Rule) {
+	val, ok := rc.Ea.metrics.Load(rule.UniqueId)
+	if ok {
+		m := val.(*ElasticAlertPrometheusMetrics)
+		m.IngestLag.Range(func(key, value any) bool {
+			v := value.(IngestLagMetrics)
+			labelValues := []string{v.UniqueId, v.Path, v.Index, v.Stat}
+			ch <- prometheus.MustNewConstMetric(rc.IngestLagDesc, prometheus.GaugeValue, v.Value, labelValues...)
+			return true
+		})
+	}
+}
+
+func (rc *RuleStatusCollector) collectClusterMetrics(ch chan<- prometheus.Metric) {
+	rc.Ea.clusters.Range(func(key, value any) bool {
+		g := value.(*ClusterGuard)
+		ch <- prometheus.MustNewConstMetric(rc.CircuitBreakerDesc, prometheus.GaugeValue, float64(g.State()), g.EsAddress)
+		ch <- prometheus.MustNewConstMetric(rc.InFlightDesc, prometheus.GaugeValue, float64(g.InFlight()), g.EsAddress)
+		return true
+	})
+}
+
+func (rc *RuleStatusCollector) collectMSearchMetrics(ch chan<- prometheus.Metric) {
+	rc.Ea.batchers.Range(func(key, value any) bool {
+		b := value.(*MSearchBatcher)
+		batches, searches, duration := b.Stats()
+		ch <- prometheus.MustNewConstSummary(rc.MSearchBatchDesc, batches, float64(searches), nil, b.EsAddress)
+		ch <- prometheus.MustNewConstSummary(rc.MSearchLatencyDesc, batches, duration, nil, b.EsAddress)
 		return true
 	})
 }
@@ -108,14 +246,14 @@ func (rc *RuleStatusCollector) collectOpRedisMetrics(ch chan<- prometheus.Metric
 	}
 }
 
-func (rc *RuleStatusCollector) collectWebhookNotifyMetrics(ch chan<- prometheus.Metric, rule *conf.Rule) {
+func (rc *RuleStatusCollector) collectNotifyMetrics(ch chan<- prometheus.Metric, rule *conf.Rule) {
 	val, ok := rc.Ea.metrics.Load(rule.UniqueId)
 	if ok {
 		m := val.(*ElasticAlertPrometheusMetrics)
-		m.WebhookNotify.Range(func(key, value any) bool {
-			v := value.(WebhookNotifyMetrics)
-			labelValues := []string{v.UniqueId, v.Path, strconv.Itoa(v.Status)}
-			ch <- prometheus.MustNewConstMetric(rc.WebhookNotifyDesc, prometheus.CounterValue, float64(v.Value), labelValues...)
+		m.Notify.Range(func(key, value any) bool {
+			v := value.(NotifyMetrics)
+			labelValues := []string{v.UniqueId, v.Path, v.Notifier, v.Type, v.Status}
+			ch <- prometheus.MustNewConstMetric(rc.NotifyDesc, prometheus.CounterValue, float64(v.Value), labelValues...)
 			return true
 		})
 	}
@@ -137,6 +275,58 @@ func (rc *RuleStatusCollector) collectAppInfo(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(rc.AppInfoDesc, prometheus.GaugeValue, float64(1), Version)
 }
 
+func (rc *RuleStatusCollector) collectSchedule(ch chan<- prometheus.Metric, rule *conf.Rule) {
+	next, ok := rc.Ea.scheduler.NextRun(rule.UniqueId)
+	if ok {
+		ch <- prometheus.MustNewConstMetric(rc.NextRunDesc, prometheus.GaugeValue, float64(next.Unix()), rule.UniqueId, rule.FilePath)
+	}
+	count, duration, ok := rc.Ea.scheduler.EvaluationStats(rule.UniqueId)
+	if ok {
+		ch <- prometheus.MustNewConstSummary(rc.EvalDurationDesc, count, duration, nil, rule.UniqueId, rule.FilePath)
+	}
+}
+
+// collectAlerts exports the number of pending and firing alerts like the prometheus ALERTS series,
+// a tabular rule has one alert per result row group
+func (rc *RuleStatusCollector) collectAlerts(ch chan<- prometheus.Metric) {
+	alerts := map[[5]string]float64{}
+	flapping := map[[3]string]float64{}
+	rc.Ea.alerts.Range(func(key, value any) bool {
+		alert := value.(AlertContent)
+		if alert.State != Pending && alert.State != Firing {
+			return true
+		}
+		labels := alert.Rule.Query.Labels
+		alerts[[5]string{alert.Rule.UniqueId, alert.Rule.FilePath, labels["alertname"], labels["severity"], alert.State.String()}]++
+		if alert.Flapping {
+			flapping[[3]string{alert.Rule.UniqueId, alert.Rule.FilePath, labels["alertname"]}]++
+		}
+		return true
+	})
+	rc.Ea.failures.Range(func(key, value any) bool {
+		alert := value.(AlertContent)
+		if alert.State != Firing {
+			return true
+		}
+		labels := alert.GetLabels()
+		alerts[[5]string{alert.Rule.UniqueId, alert.Rule.FilePath, labels["alertname"], labels["severity"], alert.State.String()}]++
+		return true
+	})
+	for labelValues, v := range alerts {
+		ch <- prometheus.MustNewConstMetric(rc.AlertsDesc, prometheus.GaugeValue, v, labelValues[:]...)
+	}
+	for labelValues, v := range flapping {
+		ch <- prometheus.MustNewConstMetric(rc.FlappingDesc, prometheus.GaugeValue, v, labelValues[:]...)
+	}
+}
+
+func (rc *RuleStatusCollector) collectSchedulerMetrics(ch chan<- prometheus.Metric) {
+	depth, busy, lagCount, lagTotal := rc.Ea.scheduler.Stats()
+	ch <- prometheus.MustNewConstMetric(rc.QueueDepthDesc, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(rc.BusyWorkersDesc, prometheus.GaugeValue, float64(busy))
+	ch <- prometheus.MustNewConstSummary(rc.SchedulingLagDesc, lagCount, lagTotal, nil)
+}
+
 func (rc *RuleStatusCollector) collectRuleStatus(ch chan<- prometheus.Metric, rule *conf.Rule) {
 	v := float64(0)
 	if rule.Enabled {
@@ -146,7 +336,7 @@ func (rc *RuleStatusCollector) collectRuleStatus(ch chan<- prometheus.Metric, ru
 		rule.UniqueId,
 		rule.FilePath,
 		strings.Join(rule.ES.Addresses, ","),
-		rule.Index, strconv.Itoa(rule.RunEvery.GetSeconds()),
+		rule.GetIndex(), strconv.Itoa(rule.RunEvery.GetSeconds()),
 		rule.Query.Type,
 	}
 	ch <- prometheus.MustNewConstMetric(rc.RuleStatusDesc, prometheus.GaugeValue, v, labels...)
@@ -184,10 +374,94 @@ func NewRuleStatusCollector(ea *ElasticAlert) *RuleStatusCollector {
 			[]string{"unique_id", "path", "cmd", "key", "status"},
 			prometheus.Labels{},
 		),
-		WebhookNotifyDesc: prometheus.NewDesc(
-			ea.buildFQName("webhook_notify"),
-			"Show call webhook notify alert times",
-			[]string{"unique_id", "path", "status"},
+		NotifyDesc: prometheus.NewDesc(
+			ea.buildFQName("notify"),
+			"Show notify alert times of every notifier, status: success、failure",
+			[]string{"unique_id", "path", "notifier", "type", "status"},
+			prometheus.Labels{},
+		),
+		SkippedDesc: prometheus.NewDesc(
+			ea.buildFQName("skipped"),
+			"Show rule evaluation skipped times, e.g reason: circuit_open、inactive_time、still_running",
+			[]string{"unique_id", "path", "es_address", "reason"},
+			prometheus.Labels{},
+		),
+		IncompleteDesc: prometheus.NewDesc(
+			ea.buildFQName("query_incomplete"),
+			"Show every rule elasticsearch query times with incomplete results, reason: timed_out、partial",
+			[]string{"unique_id", "path", "es_address", "index", "reason"},
+			prometheus.Labels{},
+		),
+		CircuitBreakerDesc: prometheus.NewDesc(
+			ea.buildFQName("circuit_breaker"),
+			"Elasticsearch cluster circuit breaker state: closed(0)、open(1)、half-open(2)",
+			[]string{"es_address"},
+			prometheus.Labels{},
+		),
+		InFlightDesc: prometheus.NewDesc(
+			ea.buildFQName("in_flight_searches"),
+			"Elasticsearch cluster in-flight search requests",
+			[]string{"es_address"},
+			prometheus.Labels{},
+		),
+		NextRunDesc: prometheus.NewDesc(
+			ea.buildFQName("next_run_timestamp_seconds"),
+			"Unix timestamp of the next scheduled rule evaluation",
+			[]string{"unique_id", "path"},
+			prometheus.Labels{},
+		),
+		AlertsDesc: prometheus.NewDesc(
+			ea.buildFQName("alerts"),
+			"Number of pending and firing alerts, alertstate: pending、firing",
+			[]string{"unique_id", "path", "alertname", "severity", "alertstate"},
+			prometheus.Labels{},
+		),
+		FlappingDesc: prometheus.NewDesc(
+			ea.buildFQName("alerts_flapping"),
+			"Number of alerts held firing by the flapping detection",
+			[]string{"unique_id", "path", "alertname"},
+			prometheus.Labels{},
+		),
+		EvalDurationDesc: prometheus.NewDesc(
+			ea.buildFQName("evaluation_duration_seconds"),
+			"Rule evaluation duration in seconds",
+			[]string{"unique_id", "path"},
+			prometheus.Labels{},
+		),
+		QueueDepthDesc: prometheus.NewDesc(
+			ea.buildFQName("scheduler_queue_depth"),
+			"Number of due rule evaluations waiting for a free worker",
+			nil,
+			prometheus.Labels{},
+		),
+		BusyWorkersDesc: prometheus.NewDesc(
+			ea.buildFQName("scheduler_busy_workers"),
+			"Number of workers evaluating a rule",
+			nil,
+			prometheus.Labels{},
+		),
+		SchedulingLagDesc: prometheus.NewDesc(
+			ea.buildFQName("scheduler_lag_seconds"),
+			"Delay between the scheduled time of a rule evaluation and its start",
+			nil,
+			prometheus.Labels{},
+		),
+		IngestLagDesc: prometheus.NewDesc(
+			ea.buildFQName("ingest_lag_seconds"),
+			"Delay between the document timestamp and its ingested_field of the documents fetched by the last rule evaluation, stat: max、avg",
+			[]string{"unique_id", "path", "index", "stat"},
+			prometheus.Labels{},
+		),
+		MSearchBatchDesc: prometheus.NewDesc(
+			ea.buildFQName("msearch_batch_size"),
+			"Number of rule searches sent within every elasticsearch _msearch request",
+			[]string{"es_address"},
+			prometheus.Labels{},
+		),
+		MSearchLatencyDesc: prometheus.NewDesc(
+			ea.buildFQName("msearch_duration_seconds"),
+			"Elasticsearch _msearch request duration in seconds",
+			[]string{"es_address"},
 			prometheus.Labels{},
 		),
 	}
@@ -0,0 +1,103 @@
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
+	"strconv"
+	"time"
+)
+
+// runRowQuery runs tabular rule queries (sql, esql), every returned row is a candidate match.
+// noData is set when the query returned no row.
+func (ea *ElasticAlert) runRowQuery(r *conf.Rule, guard *ClusterGuard, start time.Time, end time.Time) ([]Match, bool, error) {
+	var query func(body string) ([]map[string]any, int, error)
+	var body string
+	switch r.GetQueryMode() {
+	case conf.QueryModeSQL:
+		if client := xelastic.NewElasticClient(r.ES, r.ES.Version); client != nil {
+			query = client.QueryBySQL
+		}
+		body = r.GetSQLBody(start, end)
+	case conf.QueryModeESQL:
+		if client := xelastic.NewESQLClient(r.ES); client != nil {
+			query = client.QueryByESQL
+		}
+		body = r.GetESQLBody(start, end)
+	}
+	if query == nil {
+		t := fmt.Sprintf("%s elasticsearch client is nil", r.UniqueId)
+		logger.Logger.Errorln(t)
+		return nil, false, errors.New("elasticsearch client is nil")
+	}
+	guard.Acquire()
+	rows, statusCode, err := query(body)
+	guard.Release()
+	guard.Report(statusCode)
+	go ea.addQueryMetrics(r, statusCode)
+	if err != nil {
+		t := fmt.Sprintf("rule: %s %s query error: %s", r.FilePath, r.GetQueryMode(), err.Error())
+		logger.Logger.Errorln(t)
+		return nil, false, err
+	}
+	t := fmt.Sprintf("rules: %s %s: %s rows_num: %d", r.FilePath, r.GetQueryMode(), body, len(rows))
+	logger.Logger.Debugln(t)
+	return GetRowMatches(r, rows, end), len(rows) == 0, nil
+}
+
+// GetRowMatches converts every result row into a candidate match with its own alert, the row columns
+// are the alert labels and template variables. value_column is the alert value, without it the value is 1.
+func GetRowMatches(r *conf.Rule, rows []map[string]any, at time.Time) []Match {
+	matches := []Match{}
+	for _, row := range rows {
+		v := float64(1)
+		if r.Query.ValueColumn != "" {
+			var ok bool
+			v, ok = toFloat(row[r.Query.ValueColumn])
+			if !ok {
+				t := fmt.Sprintf("rule: %s value_column %s is not a number: %v", r.FilePath, r.Query.ValueColumn, row[r.Query.ValueColumn])
+				logger.Logger.Warningln(t)
+				continue
+			}
+		}
+		matches = append(matches, Match{
+			r:          r,
+			StartsAt:   at,
+			EndsAt:     at,
+			HitsNumber: int(v),
+			Value:      v,
+			Row:        row,
+		})
+	}
+	return matches
+}
+
+// FilterRowMatchCondition returns every row whose value reaches num_events. Without value_column the
+// query itself is the condition, every returned row matches.
+func FilterRowMatchCondition(r *conf.Rule, matches []Match) []Match {
+	filtered := []Match{}
+	for _, m := range matches {
+		if r.Query.ValueColumn == "" || m.Value >= float64(r.Query.Config.NumEvents) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, e := strconv.ParseFloat(n, 64)
+		return f, e == nil
+	default:
+		return 0, false
+	}
+}
@@ -1,7 +1,12 @@
 package boot
 
 import (
+	"fmt"
 	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -12,10 +17,82 @@ type Match struct {
 	StartsAt   time.Time
 	EndsAt     time.Time
 	HitsNumber int
+	// Value and Row are only set by tabular queries, Row is the matched result row
+	Value float64
+	Row   map[string]any
 }
 
+// Fingerprint is the key of the match alert, the rule id for documents. Every result row group of a
+// tabular query has its own alert, keyed by the rule id and the row labels.
 func (mc *Match) Fingerprint() string {
-	return mc.r.UniqueId
+	labels := mc.GetRowLabels()
+	if len(labels) == 0 {
+		return mc.r.UniqueId
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f := []string{}
+	for _, k := range keys {
+		f = append(f, k+"="+labels[k])
+	}
+	return mc.r.UniqueId + "/" + utils.MD5(strings.Join(f, ","))
+}
+
+// GetValue returns the alert value used by templates
+func (mc *Match) GetValue() string {
+	if mc.Row != nil {
+		return strconv.FormatFloat(mc.Value, 'f', -1, 64)
+	}
+	return strconv.Itoa(mc.HitsNumber)
+}
+
+// GetRowLabels returns the result row columns as labels, except the value column
+func (mc *Match) GetRowLabels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range mc.Row {
+		if k == mc.r.Query.ValueColumn {
+			continue
+		}
+		labels[labelName(k)] = fmt.Sprintf("%v", v)
+	}
+	return labels
+}
+
+// labelName converts a column name into a valid prometheus label name
+func labelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		ok := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// isRuleAlertKey reports whether key is the key of one of the rule alerts
+func isRuleAlertKey(r *conf.Rule, key string) bool {
+	return key == r.UniqueId || alertKeyRuleId(key) == r.UniqueId
+}
+
+// alertKeyRuleId returns the rule id of a result row group alert key, the key itself for other alerts
+func alertKeyRuleId(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i < 0 || len(key)-i-1 != 32 {
+		return key
+	}
+	return key[:i]
+}
+
+// toMatches returns the match in a list, an empty list when there is no match
+func toMatches(match *Match) []Match {
+	if match == nil {
+		return []Match{}
+	}
+	return []Match{*match}
 }
 
 type RuleType interface {
@@ -37,6 +114,7 @@ func (fr *FrequencyRule) FilterMatchCondition(r *conf.Rule, matches []Match) *Ma
 	return match
 }
 func (fr *FrequencyRule) GetMatches(r *conf.Rule, resultHits []any) []Match {
+	resultHits = filterTimestampHits(r, resultHits)
 	matches := make([]Match, 10)
 	hasAgg := false
 	var match Match
@@ -44,9 +122,7 @@ func (fr *FrequencyRule) GetMatches(r *conf.Rule, resultHits []any) []Match {
 		item := resultHits[i]
 		m := item.(map[string]any)
 		_id := m["_id"].(string)
-		_source := m["_source"].(map[string]any)
-		timestamp := _source["@timestamp"].(string)
-		ts, _ := time.Parse(time.RFC3339, timestamp)
+		ts, _ := r.Timestamp.GetTime(m)
 		match.HitsNumber = len(resultHits)
 		if !hasAgg {
 			match.StartsAt = ts
@@ -72,6 +148,22 @@ func (fr *FrequencyRule) GetMatches(r *conf.Rule, resultHits []any) []Match {
 	return matches
 }
 
+// filterTimestampHits drops the hits whose timestamp is missing or cannot be parsed
+func filterTimestampHits(r *conf.Rule, hits []any) []any {
+	valid := make([]any, 0, len(hits))
+	for _, item := range hits {
+		m, _ := item.(map[string]any)
+		if _, ok := r.Timestamp.GetTime(m); ok {
+			valid = append(valid, item)
+		}
+	}
+	if n := len(hits) - len(valid); n > 0 {
+		t := fmt.Sprintf("rule: %s skipped %d hits without a valid %s timestamp", r.FilePath, n, r.Timestamp.GetField())
+		logger.Logger.Warningln(t)
+	}
+	return valid
+}
+
 func NewRuleType(t string) RuleType {
 	t = strings.ToLower(t)
 	m := map[string]RuleType{
@@ -4,18 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/creasty/defaults"
 	"github.com/dream-mo/prom-elastic-alert/conf"
-	"github.com/dream-mo/prom-elastic-alert/utils/alertmanager"
 	"github.com/dream-mo/prom-elastic-alert/utils/logger"
 	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
 	"github.com/dream-mo/prom-elastic-alert/utils/xelastic"
 	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
-	"github.com/go-co-op/gocron"
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"math"
+	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,25 +27,30 @@ var (
 )
 
 const (
-	innerSendAlertJobId = "__send_alert__"
-	namespace           = "prom_elastic_alert"
-	Version             = "1.0.0"
+	namespace = "prom_elastic_alert"
+	Version   = "1.0.0"
 )
 
 type ElasticAlert struct {
-	appConf    *conf.AppConfig
-	opts       *conf.FlagOption
-	loader     Loader
-	rules      sync.Map // map[string]*conf.Rule
-	metrics    sync.Map // map[string]*ElasticAlertPrometheusMetrics
-	schedulers sync.Map // map[string]ElasticJob
-	alerts     sync.Map // map[string]AlertContent
-}
-
-type ElasticJob struct {
-	Scheduler *gocron.Scheduler
-	StartsAt  *time.Time
-	EndsAt    *time.Time
+	appConf   *conf.AppConfig
+	opts      *conf.FlagOption
+	loader    Loader
+	rules     sync.Map // map[string]*conf.Rule
+	metrics   sync.Map // map[string]*ElasticAlertPrometheusMetrics
+	scheduler *RuleScheduler
+	alerts    sync.Map // map[string]AlertContent
+	clusters  sync.Map // map[string]*ClusterGuard
+	batchers  sync.Map // map[string]*MSearchBatcher
+	windows   sync.Map // map[string]*RuleWindow
+	flaps     sync.Map // map[string]*FlapState
+	failures  sync.Map // map[string]AlertContent
+	// evaluated are the rules evaluated since they were started, the first evaluation starts the catch-up
+	evaluated sync.Map // map[string]bool
+	// alertLocks are the locks of the rule alerts by rule
+	alertLocks sync.Map // map[string]*sync.Mutex
+	// stop ends the send alert job, jobs waits for it
+	stop chan struct{}
+	jobs sync.WaitGroup
 }
 
 func (ea *ElasticAlert) Start() {
@@ -55,19 +61,19 @@ func (ea *ElasticAlert) Start() {
 	config := ea.appConf.Loader.Config
 	loader.InjectConfig(config)
 	logger.Logger.Infoln("Rules loading...")
+	ea.scheduler.Start()
 	rules := ea.loader.GetRules()
 	for _, rule := range rules {
-		go ea.startJobScheduler(rule)
+		ea.startJobScheduler(rule)
+	}
+	ea.cleanAlertStates(rules)
+	for _, e := range ea.validateNotifiers() {
+		logger.Logger.Errorln(e.Error())
 	}
 
 	// Publish alert to redis task
-	sendAlertScheduler := gocron.NewScheduler(xtime.Zone).SingletonMode()
-	sendAlertScheduler.Every(ea.appConf.RunEvery.GetSeconds()).Second().Do(ea.pushAlert)
-	sendAlertScheduler.StartAsync()
-	job := ElasticJob{
-		Scheduler: sendAlertScheduler,
-	}
-	ea.schedulers.Store(innerSendAlertJobId, job)
+	ea.jobs.Add(1)
+	go ea.sendAlerts()
 	logger.Logger.Infoln("Alert worker start...")
 
 	// Dynamic reload job task
@@ -78,6 +84,22 @@ func (ea *ElasticAlert) Start() {
 	go ea.popAlert()
 }
 
+// sendAlerts pushes the alerts to the redis queue every run_every until the service is stopped,
+// a push is never started while the previous one is running
+func (ea *ElasticAlert) sendAlerts() {
+	defer ea.jobs.Done()
+	ticker := time.NewTicker(ea.appConf.RunEvery.GetTimeDuration())
+	defer ticker.Stop()
+	for {
+		ea.pushAlert()
+		select {
+		case <-ticker.C:
+		case <-ea.stop:
+			return
+		}
+	}
+}
+
 func (ea *ElasticAlert) buildFQName(name string) string {
 	return prometheus.BuildFQName(namespace, "", name)
 }
@@ -88,54 +110,69 @@ func (ea *ElasticAlert) restartJobScheduler(r *conf.Rule) {
 }
 
 func (ea *ElasticAlert) stopJobScheduler(r *conf.Rule) {
-	j, ok := ea.schedulers.Load(r.UniqueId)
-	defer func() {
-		ea.rules.Delete(r.UniqueId)
-		ea.schedulers.Delete(r.UniqueId)
-		ea.alerts.Delete(r.UniqueId)
-		ea.metrics.Delete(r.UniqueId)
-	}()
-	if ok {
-		job := j.(ElasticJob)
-		job.Scheduler.Stop()
+	ea.scheduler.Remove(r.UniqueId)
+	ea.rules.Delete(r.UniqueId)
+	for key := range ea.getRuleAlerts(r) {
+		ea.alerts.Delete(key)
 	}
+	ea.metrics.Delete(r.UniqueId)
+	ea.windows.Delete(r.UniqueId)
+	ea.evaluated.Delete(r.UniqueId)
+	ea.flaps.Range(func(key, value any) bool {
+		if isRuleAlertKey(r, key.(string)) {
+			ea.flaps.Delete(key)
+		}
+		return true
+	})
+	ea.deleteFailureAlerts(r)
 }
 func (ea *ElasticAlert) Stop() {
-	w := &sync.WaitGroup{}
-	v := 0
-	ea.schedulers.Range(func(key, value any) bool {
-		v++
+	logger.Logger.Infoln("Stop rule scheduler")
+	ea.scheduler.Stop()
+	logger.Logger.Infoln("Stop send alert job")
+	close(ea.stop)
+	ea.jobs.Wait()
+	ea.batchers.Range(func(key, value any) bool {
+		value.(*MSearchBatcher).Stop()
+		ea.batchers.Delete(key)
 		return true
 	})
-	if v > 0 {
-		w.Add(v)
-		ea.schedulers.Range(func(key, value any) bool {
-			job := value.(ElasticJob)
-			uniqueId := key.(string)
-			go func(w *sync.WaitGroup, j ElasticJob, id string) {
-				logger.Logger.Infoln("Stop job: " + id)
-				j.Scheduler.Stop()
-				w.Done()
-			}(w, job, uniqueId)
-			return true
-		})
-		w.Wait()
-	}
+}
+
+// removeJobScheduler stops a rule whose file was removed, its saved alerts are resolved and their states dropped
+func (ea *ElasticAlert) removeJobScheduler(r *conf.Rule) {
+	ea.stopJobScheduler(r)
+	rules := map[string]*conf.Rule{}
+	ea.rules.Range(func(key, value any) bool {
+		rules[key.(string)] = value.(*conf.Rule)
+		return true
+	})
+	ea.cleanAlertStates(rules)
+}
+
+// getRulesByPath returns the loaded rules of the rule file
+func (ea *ElasticAlert) getRulesByPath(path string) []*conf.Rule {
+	rules := []*conf.Rule{}
+	ea.rules.Range(func(key, value any) bool {
+		if r := value.(*conf.Rule); r.FilePath == path {
+			rules = append(rules, r)
+		}
+		return true
+	})
+	return rules
 }
 
 func (ea *ElasticAlert) startJobScheduler(r *conf.Rule) {
 	ea.stopJobScheduler(r)
 	ea.rules.Store(r.UniqueId, r)
-	jobScheduler := gocron.NewScheduler(xtime.Zone).SingletonMode()
-	_, _ = jobScheduler.Every(r.RunEvery.GetSeconds()).Second().Do(ea.eval, r)
-	job := ElasticJob{
-		Scheduler: jobScheduler,
-	}
-	ea.schedulers.Store(r.UniqueId, job)
 	m := NewElasticAlertPrometheusMetrics()
 	ea.metrics.Store(r.UniqueId, m)
+	ea.restoreAlert(r)
 	if r.Enabled {
-		jobScheduler.StartAsync()
+		if err := ea.scheduler.Add(r); err != nil {
+			t := fmt.Sprintf("rule: %s schedule error: %s", r.FilePath, err.Error())
+			logger.Logger.Errorln(t)
+		}
 	} else {
 		t := fmt.Sprintf("Rule %s is disabled", r.FilePath)
 		logger.Logger.Warningln(t)
@@ -143,25 +180,121 @@ func (ea *ElasticAlert) startJobScheduler(r *conf.Rule) {
 }
 
 func (ea *ElasticAlert) eval(r *conf.Rule) {
-	hits := ea.runRuleQuery(r)
 	f := NewRuleType(r.Query.Type)
 	if f == nil {
 		t := fmt.Sprintf("rule: %s query type:【%s】 is not validate!", r.FilePath, r.Query.Type)
 		logger.Logger.Errorln(t)
 		return
 	}
-	matches := f.GetMatches(r, hits)
-	ea.filterMatches(r, f.FilterMatchCondition(r, matches))
+	if !r.IsActive(xtime.Now()) {
+		go ea.addSkippedMetrics(r, SkippedInactive)
+		t := fmt.Sprintf("rule: %s skipped: outside of active_time_ranges", r.FilePath)
+		logger.Logger.Debugln(t)
+		return
+	}
+	guard := ea.getClusterGuard(r)
+	if !guard.Allow() {
+		go ea.addSkippedMetrics(r, SkippedCircuitOpen)
+		t := fmt.Sprintf("rule: %s skipped: circuit open for %s", r.FilePath, guard.EsAddress)
+		logger.Logger.Warningln(t)
+		return
+	}
+	end := r.GetQueryEnd(xtime.Now())
+	start := ea.getQueryStart(r, end)
+	if _, ok := ea.evaluated.LoadOrStore(r.UniqueId, true); !ok {
+		if evaluatedAt := ea.loadEvaluatedAt(r); evaluatedAt != nil && evaluatedAt.Before(start) {
+			go ea.catchUp(r, guard, f, *evaluatedAt, start)
+		}
+	}
+	var matches []Match
+	var noData bool
+	var err error
+	switch r.GetQueryMode() {
+	case conf.QueryModeSQL, conf.QueryModeESQL:
+		matches, noData, err = ea.runRowQuery(r, guard, start, end)
+		matches = FilterRowMatchCondition(r, matches)
+	case conf.QueryModeEQL:
+		matches, noData, err = ea.runEQLQuery(r, guard, f, start, end)
+	default:
+		var hits []any
+		hits, noData, err = ea.runWindowQuery(r, guard, start, end)
+		matches = toMatches(f.FilterMatchCondition(r, f.GetMatches(r, hits)))
+	}
+	// A failed query is not an empty result, the alert is not resolved unless on_error is resolve
+	if err != nil {
+		t := fmt.Sprintf("rule: %s evaluation error, on_error: %s: %s", r.FilePath, r.OnError, err.Error())
+		logger.Logger.Errorln(t)
+		if ea.applyPolicy(r, r.OnError, FailureQueryError, err.Error()) {
+			ea.filterMatches(r, nil)
+		}
+		return
+	}
+	ea.saveEvaluatedAt(r, end)
+	ea.resolveFailureAlert(r, FailureQueryError)
+	if noData {
+		t := fmt.Sprintf("rule: %s query returned no data, on_no_data: %s", r.FilePath, r.OnNoData)
+		logger.Logger.Debugln(t)
+		if !ea.applyPolicy(r, r.OnNoData, FailureNoData, "the query returned no data") {
+			return
+		}
+	} else {
+		ea.resolveFailureAlert(r, FailureNoData)
+	}
+	ea.filterMatches(r, matches)
 }
 
-func (ea *ElasticAlert) filterMatches(r *conf.Rule, match *Match) {
-	alertVal, ok := ea.alerts.Load(r.UniqueId)
-	if ok {
-		alert := alertVal.(AlertContent)
-		alertCopy := alert
-		if match == nil {
+// filterMatches moves the rule alerts through inactive → pending → firing → resolved. Tabular rules have
+// one alert per result row group, the alerts of the groups missing from the matches are not matched.
+func (ea *ElasticAlert) filterMatches(r *conf.Rule, matches []Match) {
+	defer ea.lockRuleAlerts(r)()
+	now := xtime.Now()
+	matched := map[string]bool{}
+	for i := range matches {
+		key := matches[i].Fingerprint()
+		matched[key] = true
+		ea.filterMatch(r, key, &matches[i], now)
+	}
+	for key := range ea.getRuleAlerts(r) {
+		if !matched[key] {
+			ea.filterMatch(r, key, nil, now)
+		}
+	}
+	// Matched documents are not counted again by the next evaluations once an alert fires, a pending
+	// alert keeps counting them until the condition held for the rule `for` duration
+	for key := range matched {
+		if v, ok := ea.alerts.Load(key); ok && v.(AlertContent).State == Firing {
+			ea.resetRuleWindow(r)
+			return
+		}
+	}
+}
+
+// filterMatch moves one alert through its lifecycle. The alert is only sent once the condition held for
+// the rule `for` duration, and is resolved after the condition has not matched for `keep_firing_for`.
+func (ea *ElasticAlert) filterMatch(r *conf.Rule, key string, match *Match, now time.Time) {
+	flapping := ea.observeFlapping(r, key, match != nil, now)
+	alertVal, ok := ea.alerts.Load(key)
+	if ok && alertVal.(AlertContent).State != Resolved {
+		alertCopy := alertVal.(AlertContent)
+		// An alert restored from redis is reconciled by the first evaluation
+		alertCopy.Restored = false
+		if match != nil {
+			// Update alert content
+			alertCopy.Match = match
+			alertCopy.LastMatchAt = now
+			if alertCopy.State == Pending && now.Sub(*alertCopy.ActiveAt) >= r.For.GetTimeDuration() {
+				alertCopy.State = Firing
+				flapping = ea.recordFlappingTransition(r, key, now) || flapping
+			}
+			alertCopy.Flapping = flapping
+			ea.setAlert(alertCopy)
+		} else if alertCopy.State == Pending {
+			// The condition did not hold for the `for` duration, the alert was never sent
+			ea.deleteAlert(alertCopy)
+		} else if now.Sub(alertCopy.LastMatchAt) >= r.KeepFiringFor.GetTimeDuration() &&
+			!flapping && !ea.recordFlappingTransition(r, key, now) {
 			// Recovery alert
-			endsAt := xtime.Now()
+			endsAt := now
 			sub := endsAt.Sub(*alertCopy.StartsAt)
 			buff := time.Second * 30
 			if sub > buff {
@@ -171,110 +304,113 @@ func (ea *ElasticAlert) filterMatches(r *conf.Rule, match *Match) {
 				alertCopy.EndsAt = &end
 			}
 			alertCopy.State = Resolved
+			ea.setAlert(alertCopy)
 		} else {
-			// Update alert content
-			alertCopy.Match = match
+			// Keep firing, a flapping alert is held firing until it is stable
+			alertCopy.Flapping = flapping || ea.getFlapState(r, key).IsFlapping()
+			ea.setAlert(alertCopy)
 		}
-		ea.alerts.Store(r.UniqueId, alertCopy)
-	} else {
+	} else if match != nil {
 		// Add new alert
-		if match != nil {
-			alertObj := AlertContent{
-				Match:    match,
-				Rule:     r,
-				StartsAt: &match.StartsAt,
-				EndsAt:   nil,
-				State:    Pending,
-			}
-			ea.alerts.Store(r.UniqueId, alertObj)
+		alertObj := AlertContent{
+			Match:       match,
+			Rule:        r,
+			StartsAt:    &match.StartsAt,
+			EndsAt:      nil,
+			ActiveAt:    &now,
+			LastMatchAt: now,
+			State:       Pending,
 		}
-	}
-	_, ok = ea.alerts.Load(r.UniqueId)
-	if match != nil {
-		if ok {
-			j, ok := ea.schedulers.Load(r.UniqueId)
-			if ok {
-				job := j.(ElasticJob)
-				jobCopy := job
-				jobCopy.StartsAt = job.EndsAt
-				ea.schedulers.Store(r.UniqueId, jobCopy)
-			}
+		if r.For.GetTimeDuration() == 0 {
+			alertObj.State = Firing
+			alertObj.Flapping = ea.recordFlappingTransition(r, key, now) || flapping
 		}
+		ea.setAlert(alertObj)
+	}
+}
+
+func (ea *ElasticAlert) getClusterGuard(r *conf.Rule) *ClusterGuard {
+	address := r.GetEsAddress()
+	g, ok := ea.clusters.Load(address)
+	if !ok {
+		g, _ = ea.clusters.LoadOrStore(address, NewClusterGuard(address, ea.appConf))
 	}
+	return g.(*ClusterGuard)
 }
 
-func (ea *ElasticAlert) runRuleQuery(r *conf.Rule) []any {
+// runRuleQuery fetches the documents matching the rule query in [start, end], an error is returned
+// when any of the count or search requests failed
+func (ea *ElasticAlert) runRuleQuery(r *conf.Rule, guard *ClusterGuard, start time.Time, end time.Time, excludeIds []string) ([]any, error) {
 	client := xelastic.NewElasticClient(r.ES, r.ES.Version)
 	hits := []any{}
+	if client == nil {
+		t := fmt.Sprintf("%s elasticsearch client is nil", r.UniqueId)
+		logger.Logger.Errorln(t)
+		return hits, errors.New("elasticsearch client is nil")
+	}
 	size := 10000
-	from := 0
-	j, ok := ea.schedulers.Load(r.UniqueId)
-	if j == nil || !ok {
-		return hits
-	}
-	job := j.(ElasticJob)
-	var end time.Time
-	var start time.Time
-	now := xtime.Now()
-	if job.StartsAt == nil {
-		jobCopy := job
-		end = now
-		start = end.Add(-ea.appConf.BufferTime.GetTimeDuration())
-		jobCopy.StartsAt = &start
-		jobCopy.EndsAt = &end
-		ea.schedulers.Store(r.UniqueId, jobCopy)
+	indices := r.GetIndexNames(start, end)
+	opts := r.GetSearchOptions()
+	batcher := ea.getMSearchBatcher(r, guard)
+	var dsl string
+	var countResult xelastic.SearchResult
+	if batcher != nil {
+		dsl = r.GetCountSearchDSL(start, end, excludeIds...)
+		countResult = batcher.Search(xelastic.MultiSearchItem{Indices: indices, DSL: dsl, Opts: opts})
 	} else {
-		jobCopy := job
-		if now.Sub(*jobCopy.StartsAt) <= ea.appConf.BufferTime.GetTimeDuration() {
-			jobCopy.EndsAt = &now
-		} else {
-			jobCopy.EndsAt = &now
-			starts := now.Add(-ea.appConf.BufferTime.GetTimeDuration())
-			jobCopy.StartsAt = &starts
-		}
-		end = *jobCopy.EndsAt
-		start = *jobCopy.StartsAt
-		ea.schedulers.Store(r.UniqueId, jobCopy)
+		dsl = r.GetCountDSL(start, end, excludeIds...)
+		guard.Acquire()
+		countResult = client.CountByDSL(indices, dsl, opts)
+		guard.Release()
+		guard.Report(countResult.StatusCode)
 	}
-	dsl := r.GetQueryStringCountDSL(start, end)
 	dst := &bytes.Buffer{}
 	_ = json.Compact(dst, []byte(dsl))
-	count, statusCode := client.CountByDSL(r.Index, dsl)
-	go func() {
-		ea.addQueryMetrics(r, statusCode)
-	}()
-	s := fmt.Sprintf("rules: %s index: %s dsl: %s hits_num: %d", r.FilePath, r.Index, dst.String(), count)
+	go ea.addSearchResultMetrics(r, countResult)
+	var err error
+	if countResult.StatusCode != http.StatusOK {
+		err = fmt.Errorf("count request failed with status %d", countResult.StatusCode)
+	}
+	count := countResult.Total
+	s := fmt.Sprintf("rules: %s index: %s dsl: %s hits_num: %d", r.FilePath, strings.Join(indices, ","), dst.String(), count)
 	logger.Logger.Debugln(s)
-	if client != nil {
-		totalPageNum := int(math.Ceil(float64(count) / float64(size)))
-		maxPage := 0
-		if ea.appConf.MaxScrollingCount > 0 {
-			t := math.Min(float64(ea.appConf.MaxScrollingCount), float64(totalPageNum))
-			maxPage = int(t)
-		} else {
-			maxPage = totalPageNum
-		}
-		w := sync.WaitGroup{}
-		w.Add(maxPage)
-		var lock sync.Mutex
-		for p := 1; p <= maxPage; p++ {
-			go func(p int, w *sync.WaitGroup) {
-				from = (p - 1) * size
-				dsl := r.GetQueryStringDSL(from, size, start, end)
-				resultHits, _, code := client.FindByDSL(r.Index, dsl, []string{"@timestamp"})
-				ea.addQueryMetrics(r, code)
-				lock.Lock()
-				hits = append(hits, resultHits...)
-				lock.Unlock()
-				w.Done()
-			}(p, &w)
-		}
-		w.Wait()
+	totalPageNum := int(math.Ceil(float64(count) / float64(size)))
+	maxPage := 0
+	if ea.appConf.MaxScrollingCount > 0 {
+		t := math.Min(float64(ea.appConf.MaxScrollingCount), float64(totalPageNum))
+		maxPage = int(t)
 	} else {
-		t := fmt.Sprintf("%s elasticsearch client is nil", r.UniqueId)
-		logger.Logger.Errorln(t)
+		maxPage = totalPageNum
+	}
+	w := sync.WaitGroup{}
+	w.Add(maxPage)
+	var lock sync.Mutex
+	for p := 1; p <= maxPage; p++ {
+		go func(p int, w *sync.WaitGroup) {
+			defer w.Done()
+			from := (p - 1) * size
+			dsl := r.GetQueryDSL(from, size, start, end, excludeIds...)
+			source := r.GetSourceFields()
+			var result xelastic.SearchResult
+			if batcher != nil {
+				result = batcher.Search(xelastic.MultiSearchItem{Indices: indices, DSL: dsl, Source: source, Opts: opts})
+			} else {
+				guard.Acquire()
+				result = client.FindByDSL(indices, dsl, source, opts)
+				guard.Release()
+				guard.Report(result.StatusCode)
+			}
+			ea.addSearchResultMetrics(r, result)
+			lock.Lock()
+			hits = append(hits, result.Hits...)
+			if result.StatusCode != http.StatusOK && err == nil {
+				err = fmt.Errorf("search request failed with status %d", result.StatusCode)
+			}
+			lock.Unlock()
+		}(p, &w)
 	}
-	return hits
+	w.Wait()
+	return hits, err
 }
 
 func (ea *ElasticAlert) addQueryMetrics(r *conf.Rule, statusCode int) {
@@ -292,16 +428,84 @@ func (ea *ElasticAlert) addQueryMetrics(r *conf.Rule, statusCode int) {
 			UniqueId:  r.UniqueId,
 			Path:      r.FilePath,
 			EsAddress: r.GetEsAddress(),
-			Index:     r.Index,
+			Index:     r.GetIndex(),
 			Status:    statusCode,
 			Value:     1,
 		})
 	}
 }
 
+// addSearchResultMetrics records the request status, and whether the evaluation was based on incomplete data
+func (ea *ElasticAlert) addSearchResultMetrics(r *conf.Rule, result xelastic.SearchResult) {
+	ea.addQueryMetrics(r, result.StatusCode)
+	if result.TimedOut {
+		ea.addIncompleteQueryMetrics(r, IncompleteTimedOut)
+	}
+	if result.Partial {
+		ea.addIncompleteQueryMetrics(r, IncompletePartial)
+	}
+	if result.TimedOut || result.Partial {
+		t := fmt.Sprintf("rule: %s query result is incomplete, timed_out: %t partial: %t", r.FilePath, result.TimedOut, result.Partial)
+		logger.Logger.Warningln(t)
+	}
+}
+
+func (ea *ElasticAlert) addIncompleteQueryMetrics(r *conf.Rule, reason string) {
+	f := r.GetMetricsIncompleteQueryFingerprint(reason)
+	v, ok := ea.metrics.Load(r.UniqueId)
+	if !ok {
+		return
+	}
+	eam := v.(*ElasticAlertPrometheusMetrics)
+	metricsVal, ok := eam.IncompleteQuery.Load(f)
+	if ok {
+		metric := metricsVal.(IncompleteQueryMetrics)
+		metricCopy := metric
+		atomic.AddInt64(&metricCopy.Value, 1)
+		eam.IncompleteQuery.Store(f, metricCopy)
+	} else {
+		eam.IncompleteQuery.Store(f, IncompleteQueryMetrics{
+			UniqueId:  r.UniqueId,
+			Path:      r.FilePath,
+			EsAddress: r.GetEsAddress(),
+			Index:     r.GetIndex(),
+			Reason:    reason,
+			Value:     1,
+		})
+	}
+}
+
+func (ea *ElasticAlert) addSkippedMetrics(r *conf.Rule, reason string) {
+	f := r.GetMetricsSkippedFingerprint(reason)
+	v, ok := ea.metrics.Load(r.UniqueId)
+	if !ok {
+		return
+	}
+	eam := v.(*ElasticAlertPrometheusMetrics)
+	metricsVal, ok := eam.Skipped.Load(f)
+	if ok {
+		metric := metricsVal.(SkippedMetrics)
+		metricCopy := metric
+		atomic.AddInt64(&metricCopy.Value, 1)
+		eam.Skipped.Store(f, metricCopy)
+	} else {
+		eam.Skipped.Store(f, SkippedMetrics{
+			UniqueId:  r.UniqueId,
+			Path:      r.FilePath,
+			EsAddress: r.GetEsAddress(),
+			Reason:    reason,
+			Value:     1,
+		})
+	}
+}
+
 func (ea *ElasticAlert) addOpRedisMetrics(uniqueId string, path string, cmd string, key string, status int) {
 	f := conf.GetMetricsOpRedisFingerprint(uniqueId, path, cmd, key, status)
-	v, _ := ea.metrics.Load(uniqueId)
+	v, ok := ea.metrics.Load(uniqueId)
+	if !ok {
+		// The states of the removed rules are cleaned after their metrics are dropped
+		return
+	}
 	eam := v.(*ElasticAlertPrometheusMetrics)
 	metricsVal, ok := eam.OpRedis.Load(f)
 	if ok {
@@ -321,20 +525,25 @@ func (ea *ElasticAlert) addOpRedisMetrics(uniqueId string, path string, cmd stri
 	}
 }
 
-func (ea *ElasticAlert) addWebhookNotifyMetrics(uniqueId string, path string, status int) {
-	f := conf.GetMetricsWebhookNotifyFingerprint(uniqueId, path, status)
-	v, _ := ea.metrics.Load(uniqueId)
+func (ea *ElasticAlert) addNotifyMetrics(uniqueId string, path string, notifier string, notifierType string, status string) {
+	f := conf.GetMetricsNotifyFingerprint(uniqueId, path, notifier, notifierType, status)
+	v, ok := ea.metrics.Load(uniqueId)
+	if !ok {
+		return
+	}
 	eam := v.(*ElasticAlertPrometheusMetrics)
-	metricsVal, ok := eam.WebhookNotify.Load(f)
+	metricsVal, ok := eam.Notify.Load(f)
 	if ok {
-		metric := metricsVal.(WebhookNotifyMetrics)
+		metric := metricsVal.(NotifyMetrics)
 		metricCopy := metric
 		atomic.AddInt64(&metricCopy.Value, 1)
-		eam.WebhookNotify.Store(f, metricCopy)
+		eam.Notify.Store(f, metricCopy)
 	} else {
-		eam.WebhookNotify.Store(f, WebhookNotifyMetrics{
+		eam.Notify.Store(f, NotifyMetrics{
 			UniqueId: uniqueId,
 			Path:     path,
+			Notifier: notifier,
+			Type:     notifierType,
 			Status:   status,
 			Value:    1,
 		})
@@ -343,31 +552,63 @@ func (ea *ElasticAlert) addWebhookNotifyMetrics(uniqueId string, path string, st
 
 func (ea *ElasticAlert) pushAlert() {
 	ea.alerts.Range(func(key, value any) bool {
-		ruleUniqueId := key.(string)
+		alertKey := key.(string)
 		alert := value.(AlertContent)
-		redisKey := alert.getUrlHashKey()
-		msg := AlertSampleMessage{
-			ES:    alert.Rule.ES,
-			Index: alert.Rule.Index,
-			Ids:   alert.Match.Ids,
-		}
-		bs, _ := json.Marshal(msg)
-		redisx.Client.Set(ctx, redisKey, string(bs), ea.appConf.Alert.Generator.Expire.GetTimeDuration()).Result()
-		url := ea.appConf.Alert.Generator.BaseUrl + "?key=" + redisKey
-		message := alert.GetAlertMessage(url)
-		res := redisx.Client.LPush(ctx, redisx.AlertQueueListKey, message)
-		if e := res.Err(); e != nil {
-			go ea.addOpRedisMetrics(alert.Rule.UniqueId, alert.Rule.FilePath, "lpush", redisx.AlertQueueListKey, 0)
-			t := fmt.Sprintf("pushAlert redis lpush error: %s", e.Error())
-			logger.Logger.Errorln(t)
-		} else {
-			go ea.addOpRedisMetrics(alert.Rule.UniqueId, alert.Rule.FilePath, "lpush", redisx.AlertQueueListKey, 1)
+		if alert.State == Pending || (alert.Restored && alert.State == Firing) {
+			return true
 		}
 		if alert.HasResolved() {
-			ea.alerts.Delete(ruleUniqueId)
+			// Alerts throttled before their first notification are resolved silently
+			if alert.SentAt != nil {
+				ea.publishAlert(alert)
+			}
+			// A new alert of the same key may have been stored meanwhile
+			ea.deleteResolvedAlert(alert.Rule, alertKey)
+			return true
+		}
+		sentAt := xtime.Now()
+		if !ea.claimAlertSend(alert, sentAt) {
+			return true
 		}
+		ea.publishAlert(alert)
+		// The alert may have been updated by an evaluation meanwhile
+		unlock := ea.lockRuleAlerts(alert.Rule)
+		if v, ok := ea.alerts.Load(alertKey); ok {
+			current := v.(AlertContent)
+			current.SentAt = &sentAt
+			ea.setAlert(current)
+		}
+		unlock()
 		return true
 	})
+	ea.pushFailureAlerts()
+}
+
+// publishAlert stores the alert sample documents for the generator url and queues the alert message
+func (ea *ElasticAlert) publishAlert(alert AlertContent) {
+	redisKey := alert.getUrlHashKey()
+	msg := AlertSampleMessage{
+		ES:        alert.Rule.ES,
+		Index:     alert.Rule.GetIndex(),
+		Indices:   alert.Rule.GetIndexSearchPatterns(),
+		Ids:       alert.Match.Ids,
+		Timestamp: alert.Rule.Timestamp,
+	}
+	if alert.Match.Row != nil {
+		msg.Rows = []map[string]any{alert.Match.Row}
+	}
+	bs, _ := json.Marshal(msg)
+	redisx.Client.Set(ctx, redisKey, string(bs), ea.appConf.Alert.Generator.Expire.GetTimeDuration()).Result()
+	url := ea.appConf.Alert.Generator.BaseUrl + "?key=" + redisKey
+	message := alert.GetAlertMessage(url, alert.Rule.GetNotifiers(ea.appConf))
+	res := redisx.Client.LPush(ctx, redisx.AlertQueueListKey, message)
+	if e := res.Err(); e != nil {
+		go ea.addOpRedisMetrics(alert.Rule.UniqueId, alert.Rule.FilePath, "lpush", redisx.AlertQueueListKey, 0)
+		t := fmt.Sprintf("pushAlert redis lpush error: %s", e.Error())
+		logger.Logger.Errorln(t)
+	} else {
+		go ea.addOpRedisMetrics(alert.Rule.UniqueId, alert.Rule.FilePath, "lpush", redisx.AlertQueueListKey, 1)
+	}
 }
 
 func (ea *ElasticAlert) popAlert() {
@@ -386,6 +627,9 @@ func (ea *ElasticAlert) popAlert() {
 		var message AlertMessage
 		msg := val[1]
 		e := json.Unmarshal([]byte(msg), &message)
+		if e == nil && message.Payload != "" {
+			message.Alert, e = message.legacyNotification()
+		}
 		if e != nil {
 			go ea.addOpRedisMetrics(message.UniqueId, message.Path, "brpop", redisx.AlertQueueListKey, 0)
 			t := fmt.Sprintf("popAlert json.Unmarshal error: %s", e.Error())
@@ -395,21 +639,13 @@ func (ea *ElasticAlert) popAlert() {
 			now := time.Now()
 			last := now.Add(-ea.appConf.AlertTimeLimit.GetTimeDuration())
 			if message.StartsAt.After(now) {
-				t := fmt.Sprintf("Send alert message > NOW is error, not send. %s", message.Payload)
+				t := fmt.Sprintf("Send alert message > NOW is error, not send. %s", msg)
 				logger.Logger.Warningln(t)
 			} else {
-				if message.StartsAt.Before(now) && message.StartsAt.After(last) {
-					c := ea.appConf.Alert.Alertmanager
-					// Retry three times
-					for i := 0; i < 3; i++ {
-						res, code := alertmanager.HttpSendAlert(c.Url, c.BasicAuth.Username, c.BasicAuth.Password, message.Payload)
-						go ea.addWebhookNotifyMetrics(message.UniqueId, message.Path, code)
-						if res {
-							break
-						} else {
-							t := fmt.Sprintf("Retry send to alertmanager! %d times", i+1)
-							logger.Logger.Errorln(t)
-						}
+				// Alerts found during catch-up are older than alert_time_limit by design
+				if message.StartsAt.Before(now) && (message.CatchUp || message.StartsAt.After(last)) {
+					for _, rn := range ea.getMessageNotifiers(message) {
+						ea.notify(message, rn)
 					}
 				} else {
 					t := fmt.Sprintf("last: %s startsAt:%s now:%s", last.Format(time.RFC3339), message.StartsAt.Format(time.RFC3339), now.Format(time.RFC3339))
@@ -421,18 +657,52 @@ func (ea *ElasticAlert) popAlert() {
 	}
 }
 
+// notify delivers the alert message to one notifier, a failed notification is retried independently of the other notifiers
+func (ea *ElasticAlert) notify(message AlertMessage, rn conf.RuleNotifier) {
+	n, notifierType, e := ea.getNotifier(rn)
+	if e != nil {
+		go ea.addNotifyMetrics(message.UniqueId, message.Path, rn.Name, notifierType, NotifyStatusFailure)
+		t := fmt.Sprintf("rule: %s %s", message.Path, e.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	alert := message.Alert
+	if sn, ok := n.(SampleNotifier); ok {
+		alert.Samples = ea.loadSamples(message, sn.SampleLimit())
+	}
+	for i := 0; i < NotifyRetryTimes; i++ {
+		e = n.Notify(alert)
+		if e == nil {
+			go ea.addNotifyMetrics(message.UniqueId, message.Path, rn.Name, notifierType, NotifyStatusSuccess)
+			t := fmt.Sprintf("rule: %s notified %s %s", message.Path, rn.Name, message.Alert.Status)
+			logger.Logger.Debugln(t)
+			return
+		}
+		go ea.addNotifyMetrics(message.UniqueId, message.Path, rn.Name, notifierType, NotifyStatusFailure)
+		t := fmt.Sprintf("Retry send to notifier %s! %d times: %s", rn.Name, i+1, e.Error())
+		logger.Logger.Errorln(t)
+	}
+}
+
 func (ea *ElasticAlert) SetAppConf(c *conf.AppConfig) {
 	ea.appConf = c
 }
 
 func NewElasticAlert(c *conf.AppConfig, opts *conf.FlagOption) *ElasticAlert {
 	alert := &ElasticAlert{
-		appConf:    c,
-		opts:       opts,
-		alerts:     sync.Map{},
-		schedulers: sync.Map{},
-		rules:      sync.Map{},
+		appConf:   c,
+		opts:      opts,
+		alerts:    sync.Map{},
+		rules:     sync.Map{},
+		clusters:  sync.Map{},
+		batchers:  sync.Map{},
+		windows:   sync.Map{},
+		flaps:     sync.Map{},
+		failures:  sync.Map{},
+		evaluated: sync.Map{},
+		stop:      make(chan struct{}),
 	}
 	_ = defaults.Set(alert)
+	alert.scheduler = NewRuleScheduler(c, alert.eval, alert.addSkippedMetrics)
 	return alert
 }
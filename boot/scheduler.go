@@ -0,0 +1,378 @@
+package boot
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	"github.com/robfig/cron/v3"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	SkippedStillRunning  = "still_running"
+	defaultSchedulerIdle = time.Minute
+)
+
+type scheduleEntry struct {
+	rule     *conf.Rule
+	schedule cron.Schedule
+	// next is the scheduled time, the rule is dispatched at next + delay
+	next    time.Time
+	delay   time.Duration
+	queued  bool
+	running bool
+	removed bool
+	index   int
+
+	evalCount    uint64
+	evalDuration float64
+}
+
+func (se *scheduleEntry) fireAt() time.Time {
+	return se.next.Add(se.delay)
+}
+
+// entryHeap orders the entries by dispatch time
+type entryHeap []*scheduleEntry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].fireAt().Before(h[j].fireAt()) }
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *entryHeap) Push(x any) {
+	e := x.(*scheduleEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *entryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+type dueTask struct {
+	entry  *scheduleEntry
+	fireAt time.Time
+	seq    uint64
+}
+
+// taskHeap orders the due rules by priority, then by dispatch order
+type taskHeap []dueTask
+
+func (h taskHeap) Len() int { return len(h) }
+func (h taskHeap) Less(i, j int) bool {
+	pi, pj := h[i].entry.rule.Schedule.Priority, h[j].entry.rule.Schedule.Priority
+	if pi != pj {
+		return pi > pj
+	}
+	return h[i].seq < h[j].seq
+}
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *taskHeap) Push(x any)   { *h = append(*h, x.(dueTask)) }
+func (h *taskHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// RuleScheduler is the single scheduler of all rules. Due rules are queued by priority and evaluated
+// by a fixed number of workers, a rule is never queued again while its previous evaluation is not done.
+type RuleScheduler struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	entries map[string]*scheduleEntry
+	timers  entryHeap
+	ready   taskHeap
+	// inflight are the running entries by rule id, the entry of a reloaded rule waits in waiting
+	// until the evaluation of the replaced entry is done
+	inflight map[string]*scheduleEntry
+	waiting  map[string]dueTask
+	seq      uint64
+	wake     chan struct{}
+	stop     chan struct{}
+	stopped  bool
+	workers  int
+	busy     int
+	run      func(r *conf.Rule)
+	skipped  func(r *conf.Rule, reason string)
+
+	lagCount uint64
+	lagTotal float64
+}
+
+// Add schedules the rule, replacing its previous schedule
+func (rs *RuleScheduler) Add(r *conf.Rule) error {
+	schedule, err := newRuleSchedule(r)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e := &scheduleEntry{
+		rule:     r,
+		schedule: schedule,
+		delay:    r.Schedule.Offset.GetTimeDuration() + ruleJitter(r),
+	}
+	if r.Schedule.Cron != "" {
+		e.next = schedule.Next(now)
+		if e.next.IsZero() {
+			return fmt.Errorf("schedule.cron %s never matches", r.Schedule.Cron)
+		}
+	} else {
+		// Interval rules are evaluated right after being added
+		e.next = now
+	}
+	rs.lock.Lock()
+	rs.remove(r.UniqueId)
+	rs.entries[r.UniqueId] = e
+	heap.Push(&rs.timers, e)
+	rs.lock.Unlock()
+	rs.notify()
+	return nil
+}
+
+func (rs *RuleScheduler) Remove(uniqueId string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.remove(uniqueId)
+}
+
+func (rs *RuleScheduler) remove(uniqueId string) {
+	e, ok := rs.entries[uniqueId]
+	if !ok {
+		return
+	}
+	e.removed = true
+	if e.index >= 0 {
+		heap.Remove(&rs.timers, e.index)
+	}
+	delete(rs.entries, uniqueId)
+}
+
+func (rs *RuleScheduler) Has(uniqueId string) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	_, ok := rs.entries[uniqueId]
+	return ok
+}
+
+// NextRun returns the next dispatch time of the rule
+func (rs *RuleScheduler) NextRun(uniqueId string) (time.Time, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	e, ok := rs.entries[uniqueId]
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.fireAt(), true
+}
+
+// EvaluationStats returns the number of evaluations of the rule and their total duration in seconds
+func (rs *RuleScheduler) EvaluationStats(uniqueId string) (uint64, float64, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	e, ok := rs.entries[uniqueId]
+	if !ok {
+		return 0, 0, false
+	}
+	return e.evalCount, e.evalDuration, true
+}
+
+// Stats returns the queue depth, the busy workers, and the number of dispatched evaluations with
+// their total scheduling lag in seconds
+func (rs *RuleScheduler) Stats() (int, int, uint64, float64) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return len(rs.ready), rs.busy, rs.lagCount, rs.lagTotal
+}
+
+func (rs *RuleScheduler) Start() {
+	for i := 0; i < rs.workers; i++ {
+		go rs.work()
+	}
+	go rs.loop()
+}
+
+func (rs *RuleScheduler) Stop() {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.stopped {
+		return
+	}
+	rs.stopped = true
+	close(rs.stop)
+	rs.cond.Broadcast()
+}
+
+func (rs *RuleScheduler) notify() {
+	select {
+	case rs.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (rs *RuleScheduler) loop() {
+	timer := time.NewTimer(defaultSchedulerIdle)
+	defer timer.Stop()
+	for {
+		wait := rs.dispatch(time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-rs.wake:
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// dispatch queues the due rules and returns the time until the next one is due
+func (rs *RuleScheduler) dispatch(now time.Time) time.Duration {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for len(rs.timers) > 0 && !rs.timers[0].fireAt().After(now) {
+		e := rs.timers[0]
+		if e.queued || e.running {
+			go rs.skipped(e.rule, SkippedStillRunning)
+			t := fmt.Sprintf("rule: %s skipped: previous evaluation is still running", e.rule.FilePath)
+			logger.Logger.Warningln(t)
+		} else {
+			e.queued = true
+			rs.seq++
+			heap.Push(&rs.ready, dueTask{entry: e, fireAt: e.fireAt(), seq: rs.seq})
+			rs.cond.Signal()
+		}
+		// Missed runs are skipped, the next run is always in the future
+		next := e.schedule.Next(e.next)
+		for !next.IsZero() && !next.Add(e.delay).After(now) {
+			next = e.schedule.Next(next)
+		}
+		if next.IsZero() {
+			// The cron expression never matches again
+			heap.Pop(&rs.timers)
+			continue
+		}
+		e.next = next
+		heap.Fix(&rs.timers, 0)
+	}
+	if len(rs.timers) == 0 {
+		return defaultSchedulerIdle
+	}
+	return rs.timers[0].fireAt().Sub(now)
+}
+
+func (rs *RuleScheduler) work() {
+	for {
+		rs.lock.Lock()
+		for len(rs.ready) == 0 && !rs.stopped {
+			rs.cond.Wait()
+		}
+		if rs.stopped {
+			rs.lock.Unlock()
+			return
+		}
+		task := heap.Pop(&rs.ready).(dueTask)
+		e := task.entry
+		uniqueId := e.rule.UniqueId
+		if _, ok := rs.inflight[uniqueId]; ok && !e.removed {
+			// The replaced entry of the rule is still running, the task stays queued until it is done
+			rs.waiting[uniqueId] = task
+			rs.lock.Unlock()
+			continue
+		}
+		e.queued = false
+		if e.removed {
+			rs.lock.Unlock()
+			continue
+		}
+		rs.inflight[uniqueId] = e
+		e.running = true
+		rs.busy++
+		rs.lagCount++
+		rs.lagTotal += time.Since(task.fireAt).Seconds()
+		rs.lock.Unlock()
+
+		begin := time.Now()
+		rs.run(e.rule)
+		duration := time.Since(begin)
+
+		rs.lock.Lock()
+		e.running = false
+		e.evalCount++
+		e.evalDuration += duration.Seconds()
+		rs.busy--
+		delete(rs.inflight, uniqueId)
+		if w, ok := rs.waiting[uniqueId]; ok {
+			delete(rs.waiting, uniqueId)
+			heap.Push(&rs.ready, w)
+			rs.cond.Signal()
+		}
+		rs.lock.Unlock()
+	}
+}
+
+// newRuleSchedule returns the cron schedule of the rule in the rule timezone, or its run_every interval
+func newRuleSchedule(r *conf.Rule) (cron.Schedule, error) {
+	if r.Schedule.Cron != "" {
+		s, err := cron.ParseStandard(r.Schedule.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if spec, ok := s.(*cron.SpecSchedule); ok {
+			spec.Location = r.GetLocation()
+		}
+		return s, nil
+	}
+	every := r.RunEvery.GetTimeDuration()
+	if every < time.Second {
+		return nil, fmt.Errorf("run_every must be at least 1 second")
+	}
+	return cron.Every(every), nil
+}
+
+// ruleJitter returns a stable delay in [0, schedule.jitter) derived from the rule id, so that rules
+// sharing the same interval are spread over the jitter instead of starting at the same time
+func ruleJitter(r *conf.Rule) time.Duration {
+	jitter := r.Schedule.Jitter.GetTimeDuration()
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(r.UniqueId))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
+
+func NewRuleScheduler(c *conf.AppConfig, run func(r *conf.Rule), skipped func(r *conf.Rule, reason string)) *RuleScheduler {
+	workers := int(c.Scheduler.Workers)
+	if workers == 0 {
+		workers = 1
+	}
+	rs := &RuleScheduler{
+		entries:  map[string]*scheduleEntry{},
+		timers:   entryHeap{},
+		ready:    taskHeap{},
+		inflight: map[string]*scheduleEntry{},
+		waiting:  map[string]dueTask{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		workers:  workers,
+		run:      run,
+		skipped:  skipped,
+	}
+	rs.cond = sync.NewCond(&rs.lock)
+	return rs
+}
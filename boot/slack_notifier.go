@@ -0,0 +1,100 @@
+package boot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SlackNotifier sends Block Kit messages with an incoming webhook, or with a bot token to a channel
+type SlackNotifier struct {
+	WebhookUrl    string `yaml:"webhook_url"`
+	Token         string `yaml:"token"`
+	Channel       string `yaml:"channel"`
+	ApiUrl        string `yaml:"api_url" default:"https://slack.com/api/chat.postMessage"`
+	FiringColor   string `yaml:"firing_color" default:"#E01E5A"`
+	ResolvedColor string `yaml:"resolved_color" default:"#2EB67D"`
+}
+
+func (sn *SlackNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, sn); e != nil {
+		return e
+	}
+	if sn.WebhookUrl == "" && sn.Token == "" {
+		return errors.New("one of webhook_url or token is required")
+	}
+	if sn.Token != "" && sn.Channel == "" {
+		return errors.New("channel is required with token")
+	}
+	return nil
+}
+
+func (sn *SlackNotifier) Notify(n Notification) error {
+	msg := sn.getMessage(n)
+	if sn.WebhookUrl != "" {
+		_, e := postNotifyJSON(sn.WebhookUrl, msg, nil)
+		return e
+	}
+	msg["channel"] = sn.Channel
+	body, e := postNotifyJSON(sn.ApiUrl, msg, map[string]string{"Authorization": "Bearer " + sn.Token})
+	if e != nil {
+		return e
+	}
+	// The web api answers 200 with ok false on errors
+	var res struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if e := json.Unmarshal(body, &res); e != nil {
+		return e
+	}
+	if !res.Ok {
+		return fmt.Errorf("slack api error: %s", res.Error)
+	}
+	return nil
+}
+
+func (sn *SlackNotifier) getMessage(n Notification) map[string]any {
+	title := chatTitle(n)
+	blocks := []map[string]any{
+		{
+			"type": "header",
+			"text": map[string]any{"type": "plain_text", "text": title},
+		},
+	}
+	if text := chatText(n); text != "" {
+		blocks = append(blocks, map[string]any{
+			"type": "section",
+			"text": map[string]any{"type": "mrkdwn", "text": text},
+		})
+	}
+	fields := []map[string]any{}
+	for _, f := range chatFields(n) {
+		fields = append(fields, map[string]any{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", f.Title, f.Value)})
+	}
+	blocks = append(blocks, map[string]any{
+		"type":   "section",
+		"fields": fields,
+	})
+	if n.GeneratorURL != "" {
+		blocks = append(blocks, map[string]any{
+			"type": "actions",
+			"elements": []map[string]any{
+				{
+					"type": "button",
+					"text": map[string]any{"type": "plain_text", "text": "View details"},
+					"url":  n.GeneratorURL,
+				},
+			},
+		})
+	}
+	return map[string]any{
+		"text": title,
+		"attachments": []map[string]any{
+			{
+				"color":  chatColor(n, sn.FiringColor, sn.ResolvedColor),
+				"blocks": blocks,
+			},
+		},
+	}
+}
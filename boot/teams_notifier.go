@@ -0,0 +1,69 @@
+package boot
+
+import (
+	"errors"
+)
+
+// TeamsNotifier sends Adaptive Cards to a Microsoft Teams incoming webhook or workflow url.
+// The colors are Adaptive Card container styles: default, emphasis, good, attention, warning, accent.
+type TeamsNotifier struct {
+	WebhookUrl    string `yaml:"webhook_url"`
+	FiringColor   string `yaml:"firing_color" default:"attention"`
+	ResolvedColor string `yaml:"resolved_color" default:"good"`
+}
+
+func (tn *TeamsNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, tn); e != nil {
+		return e
+	}
+	if tn.WebhookUrl == "" {
+		return errors.New("webhook_url is required")
+	}
+	return nil
+}
+
+func (tn *TeamsNotifier) Notify(n Notification) error {
+	_, e := postNotifyJSON(tn.WebhookUrl, tn.getMessage(n), nil)
+	return e
+}
+
+func (tn *TeamsNotifier) getMessage(n Notification) map[string]any {
+	body := []map[string]any{
+		{
+			"type":  "Container",
+			"style": chatColor(n, tn.FiringColor, tn.ResolvedColor),
+			"bleed": true,
+			"items": []map[string]any{
+				{"type": "TextBlock", "text": chatTitle(n), "weight": "Bolder", "size": "Medium", "wrap": true},
+			},
+		},
+	}
+	if text := chatText(n); text != "" {
+		body = append(body, map[string]any{"type": "TextBlock", "text": text, "wrap": true})
+	}
+	facts := []map[string]any{}
+	for _, f := range chatFields(n) {
+		facts = append(facts, map[string]any{"title": f.Title, "value": f.Value})
+	}
+	body = append(body, map[string]any{"type": "FactSet", "facts": facts})
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if n.GeneratorURL != "" {
+		card["actions"] = []map[string]any{
+			{"type": "Action.OpenUrl", "title": "View details", "url": n.GeneratorURL},
+		}
+	}
+	return map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     card,
+			},
+		},
+	}
+}
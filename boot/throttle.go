@@ -0,0 +1,57 @@
+package boot
+
+import (
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// claimAlertSendScript records the send time in unix milliseconds unless the last send is within the
+// interval, it returns 1 when the caller may send. The check and the update are atomic, so that only
+// one replica sends the alert.
+var claimAlertSendScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[1]))
+if last and tonumber(ARGV[1]) - last < tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 1
+`)
+
+// claimAlertSend applies the rule throttling to a firing alert and claims its notification at sentAt.
+// A new alert is not sent within realert of the last notification of the same fingerprint, an alert
+// already sent is sent again after the longer of realert and resend_interval. The last notification
+// time is shared in redis, so that throttling survives restarts and works across replicas.
+func (ea *ElasticAlert) claimAlertSend(alert AlertContent, sentAt time.Time) bool {
+	r := alert.Rule
+	interval := r.Realert.GetTimeDuration()
+	expire := interval
+	if d := r.ResendInterval.GetTimeDuration(); d > expire {
+		expire = d
+	}
+	if alert.SentAt != nil {
+		interval = expire
+	}
+	if expire == 0 {
+		return true
+	}
+	key := redisx.AlertSentKeyPrefix + alert.Fingerprint()
+	ok, err := claimAlertSendScript.Run(ctx, redisx.Client, []string{key},
+		sentAt.UnixMilli(), interval.Milliseconds(), expire.Milliseconds()).Int()
+	if err != nil {
+		// The alert is sent when redis is unavailable, a duplicate is better than a lost alert
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "eval", key, 0)
+		t := fmt.Sprintf("rule: %s claim alert send error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return true
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "eval", key, 1)
+	if ok == 0 {
+		t := fmt.Sprintf("rule: %s alert throttled, sent within %s", r.FilePath, interval)
+		logger.Logger.Debugln(t)
+		return false
+	}
+	return true
+}
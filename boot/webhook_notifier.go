@@ -0,0 +1,110 @@
+package boot
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// WebhookNotifier sends the alerts to any http endpoint. The request body is rendered by a go template
+// with the Notification, e.g. {{.Labels.alertname}} {{.HitsNumber}} {{range .Samples}}{{json .}}{{end}},
+// the notification is sent as json when no body template is configured.
+type WebhookNotifier struct {
+	Url       string            `yaml:"url"`
+	Method    string            `yaml:"method" default:"POST"`
+	Headers   map[string]string `yaml:"headers"`
+	BasicAuth struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"basic_auth"`
+	BearerToken string `yaml:"bearer_token"`
+	// Hmac signs the request body with the secret, the hex digest is sent in the header
+	Hmac struct {
+		Secret    string `yaml:"secret"`
+		Header    string `yaml:"header" default:"X-Signature"`
+		Algorithm string `yaml:"algorithm" default:"sha256"`
+	} `yaml:"hmac"`
+	Body         string `yaml:"body"`
+	ResolvedBody string `yaml:"resolved_body"`
+	MaxSamples   int    `yaml:"max_samples" default:"10"`
+}
+
+func (wn *WebhookNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, wn); e != nil {
+		return e
+	}
+	if wn.Url == "" {
+		return errors.New("url is required")
+	}
+	if _, e := wn.newHash(); e != nil {
+		return e
+	}
+	return nil
+}
+
+func (wn *WebhookNotifier) SampleLimit() int {
+	return wn.MaxSamples
+}
+
+func (wn *WebhookNotifier) Notify(n Notification) error {
+	body, e := wn.getBody(n)
+	if e != nil {
+		return fmt.Errorf("webhook body template error: %s", e.Error())
+	}
+	req, e := http.NewRequest(strings.ToUpper(wn.Method), wn.Url, strings.NewReader(body))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range wn.Headers {
+		req.Header.Set(k, v)
+	}
+	if wn.BasicAuth.Username != "" {
+		req.SetBasicAuth(wn.BasicAuth.Username, wn.BasicAuth.Password)
+	}
+	if wn.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+wn.BearerToken)
+	}
+	if wn.Hmac.Secret != "" {
+		h, _ := wn.newHash()
+		h.Write([]byte(body))
+		req.Header.Set(wn.Hmac.Header, hex.EncodeToString(h.Sum(nil)))
+	}
+	_, e = doNotifyRequest(req)
+	return e
+}
+
+// getBody renders the resolved_body template for resolved alerts, the body template otherwise
+func (wn *WebhookNotifier) getBody(n Notification) (string, error) {
+	tpl := wn.Body
+	if n.IsResolved() && wn.ResolvedBody != "" {
+		tpl = wn.ResolvedBody
+	}
+	if tpl == "" {
+		bs, e := json.Marshal(n)
+		return string(bs), e
+	}
+	return renderNotifierTemplate("webhook", tpl, n)
+}
+
+func (wn *WebhookNotifier) newHash() (hash.Hash, error) {
+	secret := []byte(wn.Hmac.Secret)
+	switch strings.ToLower(wn.Hmac.Algorithm) {
+	case "sha1":
+		return hmac.New(sha1.New, secret), nil
+	case "sha256":
+		return hmac.New(sha256.New, secret), nil
+	case "sha512":
+		return hmac.New(sha512.New, secret), nil
+	default:
+		return nil, fmt.Errorf("hmac.algorithm %s is not supported", wn.Hmac.Algorithm)
+	}
+}
@@ -0,0 +1,50 @@
+package boot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WeComNotifier sends markdown messages to a WeCom group robot
+type WeComNotifier struct {
+	WebhookUrl string `yaml:"webhook_url"`
+	Template   string `yaml:"template"`
+}
+
+// wecomColors are the font colors supported by the WeCom markdown
+var wecomColors = map[string]string{
+	"firing":   "warning",
+	"critical": "warning",
+	"warning":  "comment",
+	"resolved": "info",
+}
+
+func (wn *WeComNotifier) InjectConfig(config map[string]any) error {
+	if e := decodeNotifierConfig(config, wn); e != nil {
+		return e
+	}
+	if wn.WebhookUrl == "" {
+		return errors.New("webhook_url is required")
+	}
+	return nil
+}
+
+func (wn *WeComNotifier) Notify(n Notification) error {
+	content, e := renderMarkdown("wecom", wn.Template, n, wecomColors, func(color string, text string) string {
+		return fmt.Sprintf(`<font color="%s">%s</font>`, color, text)
+	})
+	if e != nil {
+		return fmt.Errorf("wecom template error: %s", e.Error())
+	}
+	msg := map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]any{
+			"content": content,
+		},
+	}
+	body, e := postNotifyJSON(wn.WebhookUrl, msg, nil)
+	if e != nil {
+		return e
+	}
+	return checkBotResponse(body)
+}
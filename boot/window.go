@@ -0,0 +1,292 @@
+package boot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	redisx "github.com/dream-mo/prom-elastic-alert/utils/redis"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueryCursor is the position of the last fetched document of a rule. Ids are the documents sharing
+// the cursor timestamp. Matched is the position of the newest document counted by the last match,
+// the window is rebuilt after it on start so that the documents which already fired are not counted again.
+type QueryCursor struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Ids       []string     `json:"ids"`
+	Matched   *QueryCursor `json:"matched,omitempty"`
+}
+
+// after reports whether the document is newer than the cursor position
+func (qc *QueryCursor) after(precision time.Duration, id string, ts time.Time) bool {
+	t := ts.Truncate(precision)
+	if !t.Equal(qc.Timestamp) {
+		return t.After(qc.Timestamp)
+	}
+	for _, v := range qc.Ids {
+		if v == id {
+			return false
+		}
+	}
+	return true
+}
+
+type windowHit struct {
+	id  string
+	ts  time.Time
+	hit any
+}
+
+// RuleWindow holds the recent documents of a document query rule, every evaluation fetches the documents
+// newer than the cursor, or than late_tolerance ago for late documents, and drops the ones older than the rule timeframe.
+type RuleWindow struct {
+	lock sync.Mutex
+	hits []windowHit
+	// seen are the timestamps of the fetched documents by id, the documents dropped by a match included,
+	// the overlapping queries fetch them again and they must not be counted twice
+	seen   map[string]time.Time
+	cursor *QueryCursor
+	// floor is the persisted matched position the window was rebuilt after, the older documents
+	// fired before the start and are not counted again
+	floor *QueryCursor
+}
+
+// Add appends the new hits, drops the hits before start and moves the cursor to the newest hit.
+// The documents seen before keepFrom are forgotten, no later query fetches them again. It returns the new hits.
+func (rw *RuleWindow) Add(r *conf.Rule, hits []any, start time.Time, keepFrom time.Time) []any {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	precision := r.Timestamp.GetPrecision()
+	added := []any{}
+	for _, item := range hits {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		id, _ := m["_id"].(string)
+		if _, ok := rw.seen[id]; ok {
+			continue
+		}
+		ts, ok := r.Timestamp.GetTime(m)
+		if !ok {
+			continue
+		}
+		if rw.floor != nil && !rw.floor.after(precision, id, ts) {
+			continue
+		}
+		rw.seen[id] = ts
+		rw.hits = append(rw.hits, windowHit{id: id, ts: ts, hit: item})
+		added = append(added, item)
+	}
+	for id, ts := range rw.seen {
+		if ts.Before(keepFrom) {
+			delete(rw.seen, id)
+		}
+	}
+	sort.SliceStable(rw.hits, func(i, j int) bool {
+		return rw.hits[i].ts.Before(rw.hits[j].ts)
+	})
+	i := 0
+	for i < len(rw.hits) && rw.hits[i].ts.Before(start) {
+		i++
+	}
+	rw.hits = rw.hits[i:]
+	if len(rw.hits) == 0 {
+		return added
+	}
+	last := rw.hits[len(rw.hits)-1].ts.Truncate(precision)
+	if rw.cursor != nil && last.Before(rw.cursor.Timestamp) {
+		return added
+	}
+	cursor := &QueryCursor{Timestamp: last, Ids: []string{}}
+	if rw.cursor != nil {
+		cursor.Matched = rw.cursor.Matched
+	}
+	for j := len(rw.hits) - 1; j >= 0 && !rw.hits[j].ts.Truncate(precision).Before(last); j-- {
+		cursor.Ids = append(cursor.Ids, rw.hits[j].id)
+	}
+	rw.cursor = cursor
+	return added
+}
+
+// Hits returns the window documents sorted by timestamp
+func (rw *RuleWindow) Hits() []any {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	hits := make([]any, len(rw.hits))
+	for i, h := range rw.hits {
+		hits[i] = h.hit
+	}
+	return hits
+}
+
+// Reset drops the window documents after a match, the seen ids are kept and the cursor records
+// the matched position. It returns the new cursor.
+func (rw *RuleWindow) Reset() *QueryCursor {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.hits = []windowHit{}
+	if rw.cursor != nil {
+		rw.cursor = &QueryCursor{
+			Timestamp: rw.cursor.Timestamp,
+			Ids:       rw.cursor.Ids,
+			Matched:   &QueryCursor{Timestamp: rw.cursor.Timestamp, Ids: rw.cursor.Ids},
+		}
+	}
+	return rw.cursor
+}
+
+func (rw *RuleWindow) Cursor() *QueryCursor {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return rw.cursor
+}
+
+func NewRuleWindow(cursor *QueryCursor) *RuleWindow {
+	rw := &RuleWindow{
+		hits:   []windowHit{},
+		seen:   map[string]time.Time{},
+		cursor: cursor,
+	}
+	if cursor != nil {
+		rw.floor = cursor.Matched
+	}
+	return rw
+}
+
+// runWindowQuery fetches the new documents of the rule and returns the documents of the sliding window.
+// The window is rebuilt from elasticsearch on the first evaluation after a start or a reload, after the
+// documents of the persisted last match. Later queries only fetch the documents after the cursor, the
+// documents at the cursor timestamp are excluded by id. With late_tolerance they start that long before the
+// end when it is older than the cursor, so that late documents are still fetched, the seen ids are not counted twice.
+// The window and the cursor are left untouched when the query failed. noData is set when no document
+// was found within the window, the documents already matched and dropped from the window still count as data.
+func (ea *ElasticAlert) runWindowQuery(r *conf.Rule, guard *ClusterGuard, windowStart time.Time, end time.Time) ([]any, bool, error) {
+	start := windowStart
+	var excludeIds []string
+	v, ok := ea.windows.Load(r.UniqueId)
+	if !ok {
+		cursor := ea.loadCursor(r)
+		v, _ = ea.windows.LoadOrStore(r.UniqueId, NewRuleWindow(cursor))
+		if cursor != nil && cursor.Matched != nil && cursor.Matched.Timestamp.After(windowStart) {
+			start = cursor.Matched.Timestamp
+			excludeIds = cursor.Matched.Ids
+		}
+		t := fmt.Sprintf("rule: %s rebuild window from %s", r.FilePath, xtime.TimeFormatISO8601(start))
+		logger.Logger.Debugln(t)
+	} else if cursor := v.(*RuleWindow).Cursor(); cursor != nil {
+		from, ids := cursor.Timestamp, cursor.Ids
+		if late := r.LateTolerance.GetTimeDuration(); late > 0 && end.Add(-late).Before(from) {
+			from, ids = end.Add(-late), nil
+		}
+		if from.After(windowStart) {
+			start = from
+			excludeIds = ids
+		}
+	}
+	window := v.(*RuleWindow)
+	before := window.Cursor()
+	hits, err := ea.runRuleQuery(r, guard, start, end, excludeIds)
+	if err != nil {
+		return nil, false, err
+	}
+	added := window.Add(r, filterTimestampHits(r, hits), windowStart, start)
+	if r.IngestedField != "" && len(added) > 0 {
+		go ea.addIngestLagMetrics(r, added)
+	}
+	after := window.Cursor()
+	if after != nil && after != before {
+		ea.saveCursor(r, after)
+	}
+	noData := after == nil || after.Timestamp.Before(windowStart.Truncate(r.Timestamp.GetPrecision()))
+	return window.Hits(), noData, nil
+}
+
+// addIngestLagMetrics records the max and average ingest lag of the documents fetched by the evaluation
+func (ea *ElasticAlert) addIngestLagMetrics(r *conf.Rule, hits []any) {
+	var max time.Duration
+	var sum time.Duration
+	n := 0
+	for _, item := range hits {
+		m, _ := item.(map[string]any)
+		lag, ok := r.GetIngestLag(m)
+		if !ok {
+			continue
+		}
+		if lag > max {
+			max = lag
+		}
+		sum += lag
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	v, ok := ea.metrics.Load(r.UniqueId)
+	if !ok {
+		return
+	}
+	eam := v.(*ElasticAlertPrometheusMetrics)
+	values := map[string]float64{
+		IngestLagMax: max.Seconds(),
+		IngestLagAvg: (sum / time.Duration(n)).Seconds(),
+	}
+	for stat, value := range values {
+		eam.IngestLag.Store(r.GetMetricsIngestLagFingerprint(stat), IngestLagMetrics{
+			UniqueId: r.UniqueId,
+			Path:     r.FilePath,
+			Index:    r.GetIndex(),
+			Stat:     stat,
+			Value:    value,
+		})
+	}
+}
+
+func (ea *ElasticAlert) resetRuleWindow(r *conf.Rule) {
+	v, ok := ea.windows.Load(r.UniqueId)
+	if !ok {
+		return
+	}
+	if cursor := v.(*RuleWindow).Reset(); cursor != nil {
+		ea.saveCursor(r, cursor)
+	}
+}
+
+func (ea *ElasticAlert) loadCursor(r *conf.Rule) *QueryCursor {
+	key := redisx.RuleCursorKeyPrefix + r.UniqueId
+	val, err := redisx.Client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "get", key, 0)
+		t := fmt.Sprintf("rule: %s load cursor error: %s", r.FilePath, err.Error())
+		logger.Logger.Errorln(t)
+		return nil
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "get", key, 1)
+	var cursor QueryCursor
+	if e := json.Unmarshal([]byte(val), &cursor); e != nil {
+		t := fmt.Sprintf("rule: %s cursor json.Unmarshal error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return nil
+	}
+	return &cursor
+}
+
+func (ea *ElasticAlert) saveCursor(r *conf.Rule, cursor *QueryCursor) {
+	key := redisx.RuleCursorKeyPrefix + r.UniqueId
+	bs, _ := json.Marshal(cursor)
+	if e := redisx.Client.Set(ctx, key, string(bs), 0).Err(); e != nil {
+		go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "set", key, 0)
+		t := fmt.Sprintf("rule: %s save cursor error: %s", r.FilePath, e.Error())
+		logger.Logger.Errorln(t)
+		return
+	}
+	go ea.addOpRedisMetrics(r.UniqueId, r.FilePath, "set", key, 1)
+}
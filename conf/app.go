@@ -40,7 +40,9 @@ type AppConfig struct {
 				Password string `yaml:"password"`
 			} `yaml:"basic_auth"`
 		} `yaml:"alertmanager"`
-		Generator struct {
+		Notifiers        map[string]NotifierConfig `yaml:"notifiers"`
+		DefaultNotifiers []string                  `yaml:"default_notifiers"`
+		Generator        struct {
 			BaseUrl string          `yaml:"base_url"`
 			Expire  xtime.TimeLimit `yaml:"expire"`
 		} `yaml:"generator"`
@@ -55,6 +57,26 @@ type AppConfig struct {
 		WriteTimeout int    `yaml:"write_timeout" default:"30"`
 		DialTimeout  int    `yaml:"dial_timeout" default:"5"`
 	} `yaml:"redis"`
+	Elasticsearch struct {
+		MaxConcurrentSearches uint `yaml:"max_concurrent_searches" default:"10"`
+		CircuitBreaker        struct {
+			Enabled          bool            `yaml:"enabled" default:"true"`
+			FailureThreshold uint            `yaml:"failure_threshold" default:"5"`
+			OpenTimeout      xtime.TimeLimit `yaml:"open_timeout"`
+		} `yaml:"circuit_breaker"`
+		MSearch struct {
+			Enabled       bool `yaml:"enabled" default:"false"`
+			MaxBatchSize  uint `yaml:"max_batch_size" default:"50"`
+			BatchWindowMs uint `yaml:"batch_window_ms" default:"200"`
+		} `yaml:"msearch"`
+	} `yaml:"elasticsearch"`
+	Scheduler struct {
+		Workers uint `yaml:"workers" default:"10"`
+	} `yaml:"scheduler"`
+	CatchUp struct {
+		Enabled  bool            `yaml:"enabled" default:"true"`
+		MaxRange xtime.TimeLimit `yaml:"max_range"`
+	} `yaml:"catch_up"`
 	RunEvery          xtime.TimeLimit `yaml:"run_every"`
 	BufferTime        xtime.TimeLimit `yaml:"buffer_time"`
 	AlertTimeLimit    xtime.TimeLimit `yaml:"alert_time_limit"`
@@ -0,0 +1,347 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDateMathFormat = "yyyy.MM.dd"
+
+// dateMathIndex is an elasticsearch date math index name, e.g. <logs-{now/d}> or <logs-{now/M{yyyy.MM}}>.
+// The name is resolved locally for every time of the query window instead of being sent to elasticsearch,
+// so that a window crossing a day boundary queries the indices of both days.
+type dateMathIndex struct {
+	parts []dateMathPart
+}
+
+// dateMathPart is a static text or a date math expression of the index name
+type dateMathPart struct {
+	text string
+	expr *dateMathExpr
+}
+
+type dateMathExpr struct {
+	ops    []dateMathOp
+	layout string
+	loc    *time.Location
+	// step is the interval the resolved name is evaluated at over a time range
+	step time.Duration
+}
+
+// dateMathOp is an arithmetic operation (+1d, -2h) or a rounding (/d) on now
+type dateMathOp struct {
+	op   byte
+	n    int
+	unit byte
+}
+
+func isDateMathIndex(name string) bool {
+	return strings.HasPrefix(name, "<") && strings.HasSuffix(name, ">")
+}
+
+func parseDateMathIndex(name string) (*dateMathIndex, error) {
+	if !isDateMathIndex(name) {
+		return nil, fmt.Errorf("date math index %s must be enclosed in < >", name)
+	}
+	inner := name[1 : len(name)-1]
+	index := &dateMathIndex{}
+	text := strings.Builder{}
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch c {
+		case '\\':
+			if i+1 < len(inner) {
+				i++
+				text.WriteByte(inner[i])
+			}
+		case '{':
+			// The format block {format|time_zone} is nested in the expression
+			end, depth := -1, 0
+			for j := i; j < len(inner) && end < 0; j++ {
+				switch inner[j] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+					if depth == 0 {
+						end = j
+					}
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("date math index %s: unclosed {", name)
+			}
+			expr, e := parseDateMathExpr(inner[i+1 : end])
+			if e != nil {
+				return nil, fmt.Errorf("date math index %s: %s", name, e.Error())
+			}
+			if text.Len() > 0 {
+				index.parts = append(index.parts, dateMathPart{text: text.String()})
+				text.Reset()
+			}
+			index.parts = append(index.parts, dateMathPart{expr: expr})
+			i = end
+		default:
+			text.WriteByte(c)
+		}
+	}
+	if text.Len() > 0 {
+		index.parts = append(index.parts, dateMathPart{text: text.String()})
+	}
+	return index, nil
+}
+
+// parseDateMathExpr parses now[ops][{format[|time_zone]}]
+func parseDateMathExpr(s string) (*dateMathExpr, error) {
+	math, format, _ := strings.Cut(s, "{")
+	format = strings.TrimSuffix(format, "}")
+	if !strings.HasPrefix(math, "now") {
+		return nil, errors.New("date math expression must start with now")
+	}
+	expr := &dateMathExpr{loc: time.UTC}
+	step := time.Hour
+	math = math[len("now"):]
+	for len(math) > 0 {
+		op := math[0]
+		if op != '+' && op != '-' && op != '/' {
+			return nil, fmt.Errorf("invalid date math operator %q", op)
+		}
+		math = math[1:]
+		n := 1
+		if op != '/' {
+			j := 0
+			for j < len(math) && math[j] >= '0' && math[j] <= '9' {
+				j++
+			}
+			if j == 0 {
+				return nil, fmt.Errorf("missing number after %q", op)
+			}
+			n, _ = strconv.Atoi(math[:j])
+			math = math[j:]
+		}
+		if len(math) == 0 || !strings.ContainsRune("yMwdhHms", rune(math[0])) {
+			return nil, errors.New("date math unit must be one of y M w d h H m s")
+		}
+		unit := math[0]
+		math = math[1:]
+		expr.ops = append(expr.ops, dateMathOp{op: op, n: n, unit: unit})
+		if op == '/' {
+			step = minDuration(step, unitStep(unit))
+		}
+	}
+	format, zone, _ := strings.Cut(format, "|")
+	if format == "" {
+		format = defaultDateMathFormat
+	}
+	layout, formatStep, e := javaDateLayout(format)
+	if e != nil {
+		return nil, e
+	}
+	expr.layout = layout
+	expr.step = minDuration(step, formatStep)
+	if zone != "" {
+		loc, e := loadZone(zone)
+		if e != nil {
+			return nil, e
+		}
+		expr.loc = loc
+	}
+	return expr, nil
+}
+
+// Resolve returns the index name for now
+func (di *dateMathIndex) Resolve(now time.Time) string {
+	b := strings.Builder{}
+	for _, p := range di.parts {
+		if p.expr == nil {
+			b.WriteString(p.text)
+			continue
+		}
+		b.WriteString(p.expr.eval(now).Format(p.expr.layout))
+	}
+	return b.String()
+}
+
+// ResolveRange returns the distinct index names for every time of [start, end], at most limit names
+func (di *dateMathIndex) ResolveRange(start time.Time, end time.Time, limit int) []string {
+	step := time.Hour
+	for _, p := range di.parts {
+		if p.expr != nil {
+			step = minDuration(step, p.expr.step)
+		}
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(t time.Time) {
+		name := di.Resolve(t)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for t := start; t.Before(end) && len(names) < limit; t = t.Add(step) {
+		add(t)
+	}
+	if len(names) < limit {
+		add(end)
+	}
+	return names
+}
+
+// SearchPattern returns the index name with the date math expressions replaced by wildcards
+func (di *dateMathIndex) SearchPattern() string {
+	b := strings.Builder{}
+	for _, p := range di.parts {
+		if p.expr == nil {
+			b.WriteString(p.text)
+		} else {
+			b.WriteString("*")
+		}
+	}
+	return b.String()
+}
+
+func (de *dateMathExpr) eval(now time.Time) time.Time {
+	t := now.In(de.loc)
+	for _, op := range de.ops {
+		switch op.op {
+		case '+':
+			t = addUnit(t, op.unit, op.n)
+		case '-':
+			t = addUnit(t, op.unit, -op.n)
+		case '/':
+			t = roundUnit(t, op.unit)
+		}
+	}
+	return t
+}
+
+func addUnit(t time.Time, unit byte, n int) time.Time {
+	switch unit {
+	case 'y':
+		return t.AddDate(n, 0, 0)
+	case 'M':
+		return t.AddDate(0, n, 0)
+	case 'w':
+		return t.AddDate(0, 0, 7*n)
+	case 'd':
+		return t.AddDate(0, 0, n)
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour)
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute)
+	default:
+		return t.Add(time.Duration(n) * time.Second)
+	}
+}
+
+// roundUnit rounds t down to the start of the unit in the time zone of t, weeks start on monday
+func roundUnit(t time.Time, unit byte) time.Time {
+	loc := t.Location()
+	switch unit {
+	case 'y':
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, loc)
+	case 'M':
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	case 'w':
+		days := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, loc)
+	case 'd':
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case 'h', 'H':
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case 'm':
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+	}
+}
+
+func unitStep(unit byte) time.Duration {
+	switch unit {
+	case 'm':
+		return time.Minute
+	case 's':
+		return time.Second
+	default:
+		return time.Hour
+	}
+}
+
+// javaDateLayout converts a java date format (yyyy.MM.dd) into a go layout, and returns the step of its smallest field
+func javaDateLayout(format string) (string, time.Duration, error) {
+	layouts := map[string]string{
+		"yyyy": "2006",
+		"YYYY": "2006",
+		"uuuu": "2006",
+		"yy":   "06",
+		"MM":   "01",
+		"dd":   "02",
+		"HH":   "15",
+		"mm":   "04",
+		"ss":   "05",
+	}
+	b := strings.Builder{}
+	step := time.Hour
+	for i := 0; i < len(format); {
+		c := format[i]
+		if c == '\'' {
+			end := strings.IndexByte(format[i+1:], '\'')
+			if end < 0 {
+				return "", 0, fmt.Errorf("date format %s: unclosed quote", format)
+			}
+			b.WriteString(format[i+1 : i+1+end])
+			i += end + 2
+			continue
+		}
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		j := i
+		for j < len(format) && format[j] == c {
+			j++
+		}
+		layout, ok := layouts[format[i:j]]
+		if !ok {
+			return "", 0, fmt.Errorf("date format %s: unsupported field %s", format, format[i:j])
+		}
+		b.WriteString(layout)
+		switch c {
+		case 'm':
+			step = minDuration(step, time.Minute)
+		case 's':
+			step = minDuration(step, time.Second)
+		}
+		i = j
+	}
+	return b.String(), step, nil
+}
+
+// loadZone loads a time zone id (Europe/Paris) or offset (+01:00)
+func loadZone(zone string) (*time.Location, error) {
+	if strings.HasPrefix(zone, "+") || strings.HasPrefix(zone, "-") {
+		t, e := time.Parse("-07:00", zone)
+		if e != nil {
+			return nil, fmt.Errorf("invalid time zone offset %s", zone)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(zone, offset), nil
+	}
+	loc, e := time.LoadLocation(zone)
+	if e != nil {
+		return nil, fmt.Errorf("invalid time zone %s", zone)
+	}
+	return loc, nil
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetIndexNamesDateMath(t *testing.T) {
+	start := time.Date(2023, 3, 31, 23, 50, 0, 0, time.UTC)
+	end := time.Date(2023, 4, 1, 0, 10, 0, 0, time.UTC)
+	tests := []struct {
+		index string
+		want  []string
+	}{
+		{`<nginx-error-{now/d}>`, []string{"nginx-error-2023.03.31", "nginx-error-2023.04.01"}},
+		{`<logs-{now/M{yyyy.MM}}>`, []string{"logs-2023.03", "logs-2023.04"}},
+		{`<logs-{now-1d/d}>`, []string{"logs-2023.03.30", "logs-2023.03.31"}},
+		{`<logs-{now/d{yyyy.MM.dd|+08:00}}>`, []string{"logs-2023.04.01"}},
+		{`<logs-{now/h{yyyy.MM.dd.HH}}>`, []string{"logs-2023.03.31.23", "logs-2023.04.01.00"}},
+		{`<elastic\{ON\}-{now/y{yyyy}}>`, []string{"elastic{ON}-2023"}},
+		{`<a-{now/d}>,b`, []string{"a-2023.03.31", "a-2023.04.01", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.index, func(t *testing.T) {
+			r := &Rule{Index: tt.index}
+			if e := r.ValidateIndexPatterns(); e != nil {
+				t.Fatalf("ValidateIndexPatterns(%s) error: %s", tt.index, e)
+			}
+			got := r.GetIndexNames(start, end)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetIndexNames(%s)\n got: %v\nwant: %v", tt.index, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetIndexSearchPatternsDateMath(t *testing.T) {
+	r := &Rule{Index: `<nginx-error-{now/d}>`}
+	got := r.GetIndexSearchPatterns()
+	if !reflect.DeepEqual(got, []string{"nginx-error-*"}) {
+		t.Errorf("GetIndexSearchPatterns() got: %v", got)
+	}
+}
+
+func TestValidateIndexPatternsError(t *testing.T) {
+	for _, index := range []string{`<logs-{now/d>`, `<logs-{today}>`, `<logs-{now/x}>`, `<logs-{now+d}>`, `<logs-{now/d{yyyy.QQ}}>`, `<logs-{now/d{yyyy|Mars/Olympus}}>`} {
+		r := &Rule{Index: index}
+		if e := r.ValidateIndexPatterns(); e == nil {
+			t.Errorf("ValidateIndexPatterns(%s) expected an error", index)
+		}
+	}
+}
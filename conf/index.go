@@ -0,0 +1,179 @@
+package conf
+
+import (
+	"strings"
+	"time"
+)
+
+// maxStrftimeIndices bounds the number of concrete index names of one query
+const maxStrftimeIndices = 1000
+
+var strftimeWildcardReplacer = strings.NewReplacer(
+	"%Y", "*",
+	"%y", "*",
+	"%m", "*",
+	"%d", "*",
+	"%H", "*",
+	"%%", "%",
+)
+
+// GetIndexPatterns returns the configured index patterns, `index` may be a comma separated list
+// and `indices` a list of indices, aliases or data streams
+func (rl *Rule) GetIndexPatterns() []string {
+	patterns := []string{}
+	for _, p := range strings.Split(rl.Index, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	for _, p := range rl.Indices {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// GetIndex returns the index patterns as a single string, used by logs and metrics labels
+func (rl *Rule) GetIndex() string {
+	return strings.Join(rl.GetIndexPatterns(), ",")
+}
+
+// ValidateIndexPatterns checks the elasticsearch date math index names
+func (rl *Rule) ValidateIndexPatterns() error {
+	for _, p := range rl.GetIndexPatterns() {
+		if !isDateMathIndex(p) {
+			continue
+		}
+		if _, e := parseDateMathIndex(p); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// GetIndexNames returns the indices to query for [start, end]. With use_strftime_index the
+// %Y %y %m %d %H placeholders are expanded into the concrete index names covering the window (in UTC).
+// Elasticsearch date math names like <logs-{now/d}> are resolved locally for the whole window, they
+// contain characters which are not allowed in the request path.
+func (rl *Rule) GetIndexNames(start time.Time, end time.Time) []string {
+	patterns := rl.GetIndexPatterns()
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, p := range patterns {
+		if isDateMathIndex(p) {
+			di, e := parseDateMathIndex(p)
+			if e != nil {
+				add(p)
+				continue
+			}
+			for _, name := range di.ResolveRange(start, end, maxStrftimeIndices) {
+				add(name)
+			}
+			continue
+		}
+		if !rl.UseStrftimeIndex || !strings.Contains(p, "%") {
+			add(p)
+			continue
+		}
+		step := strftimeStep(p)
+		t := truncateTime(start.UTC(), step)
+		for i := 0; !t.After(end.UTC()) && i < maxStrftimeIndices; i++ {
+			add(strftime(t, p))
+			t = addStep(t, step)
+		}
+	}
+	return names
+}
+
+// GetIndexSearchPatterns returns the index patterns with strftime placeholders and date math expressions
+// replaced by wildcards, used to look up documents when the query window is unknown
+func (rl *Rule) GetIndexSearchPatterns() []string {
+	patterns := rl.GetIndexPatterns()
+	for i, p := range patterns {
+		if isDateMathIndex(p) {
+			if di, e := parseDateMathIndex(p); e == nil {
+				patterns[i] = di.SearchPattern()
+			}
+		} else if rl.UseStrftimeIndex {
+			patterns[i] = strftimeWildcardReplacer.Replace(p)
+		}
+	}
+	return patterns
+}
+
+// strftime formats t with the %Y %y %m %d %H placeholders of pattern
+func strftime(t time.Time, pattern string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 >= len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(pattern[i])
+		}
+	}
+	return b.String()
+}
+
+// strftimeStep returns the smallest time unit used by the index pattern
+func strftimeStep(pattern string) string {
+	switch {
+	case strings.Contains(pattern, "%H"):
+		return "hour"
+	case strings.Contains(pattern, "%d"):
+		return "day"
+	case strings.Contains(pattern, "%m"):
+		return "month"
+	default:
+		return "year"
+	}
+}
+
+func truncateTime(t time.Time, step string) time.Time {
+	switch step {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func addStep(t time.Time, step string) time.Time {
+	switch step {
+	case "hour":
+		return t.Add(time.Hour)
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(1, 0, 0)
+	}
+}
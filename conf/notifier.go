@@ -0,0 +1,117 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	AlertmanagerNotifierName = "alertmanager"
+	AlertmanagerNotifierType = "alertmanager"
+)
+
+// NotifierConfig is a notifier declared in alert.notifiers, the config depends on the notifier type
+type NotifierConfig struct {
+	Type   string         `yaml:"type"`
+	Config map[string]any `yaml:"config"`
+}
+
+// RuleNotifier is a notifier of a rule, written as the notifier name or as an object whose config
+// overrides the top level keys of the notifier config for this rule
+type RuleNotifier struct {
+	Name   string         `yaml:"name" json:"name"`
+	Config map[string]any `yaml:"config" json:"config,omitempty"`
+}
+
+func (rn *RuleNotifier) UnmarshalYAML(unmarshal func(any) error) error {
+	var name string
+	if e := unmarshal(&name); e == nil {
+		rn.Name = name
+		return nil
+	}
+	var raw struct {
+		Name   string         `yaml:"name"`
+		Config map[string]any `yaml:"config"`
+	}
+	if e := unmarshal(&raw); e != nil {
+		return e
+	}
+	if raw.Name == "" {
+		return errors.New("notifiers name is required")
+	}
+	rn.Name = raw.Name
+	if raw.Config != nil {
+		rn.Config = normalizeYamlValue(raw.Config).(map[string]any)
+	}
+	return nil
+}
+
+// GetNotifiers returns the declared notifiers, alert.alertmanager is declared as the alertmanager
+// notifier unless a notifier with the same name exists
+func (c *AppConfig) GetNotifiers() map[string]NotifierConfig {
+	notifiers := map[string]NotifierConfig{}
+	for name, n := range c.Alert.Notifiers {
+		if n.Config != nil {
+			n.Config = normalizeYamlValue(n.Config).(map[string]any)
+		}
+		notifiers[name] = n
+	}
+	am := c.Alert.Alertmanager
+	if _, ok := notifiers[AlertmanagerNotifierName]; !ok && am.Url != "" {
+		notifiers[AlertmanagerNotifierName] = NotifierConfig{
+			Type: AlertmanagerNotifierType,
+			Config: map[string]any{
+				"url": am.Url,
+				"basic_auth": map[string]any{
+					"username": am.BasicAuth.Username,
+					"password": am.BasicAuth.Password,
+				},
+			},
+		}
+	}
+	return notifiers
+}
+
+// GetDefaultNotifiers returns the notifiers of the rules without notifiers, alertmanager by default
+func (c *AppConfig) GetDefaultNotifiers() []RuleNotifier {
+	names := c.Alert.DefaultNotifiers
+	if len(names) == 0 {
+		names = []string{AlertmanagerNotifierName}
+	}
+	notifiers := make([]RuleNotifier, 0, len(names))
+	for _, name := range names {
+		notifiers = append(notifiers, RuleNotifier{Name: name})
+	}
+	return notifiers
+}
+
+// GetNotifiers returns the rule notifiers, the default notifiers when the rule has none
+func (rl *Rule) GetNotifiers(c *AppConfig) []RuleNotifier {
+	if len(rl.Notifiers) > 0 {
+		return rl.Notifiers
+	}
+	return c.GetDefaultNotifiers()
+}
+
+// ValidateNotifiers checks that the rule notifiers are declared
+func (rl *Rule) ValidateNotifiers(c *AppConfig) error {
+	notifiers := c.GetNotifiers()
+	for _, n := range rl.GetNotifiers(c) {
+		if _, ok := notifiers[n.Name]; !ok {
+			return fmt.Errorf("notifier %s is not declared in alert.notifiers", n.Name)
+		}
+	}
+	return nil
+}
+
+// MergeConfig returns the notifier config overridden by the rule config
+func (rn RuleNotifier) MergeConfig(n NotifierConfig) map[string]any {
+	config := map[string]any{}
+	for k, v := range n.Config {
+		config[k] = v
+	}
+	for k, v := range rn.Config {
+		config[k] = v
+	}
+	return config
+}
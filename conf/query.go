@@ -0,0 +1,252 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// QueryDSL is a raw elasticsearch query object, it can be written as yaml object or json string
+type QueryDSL map[string]any
+
+func (q *QueryDSL) UnmarshalYAML(unmarshal func(any) error) error {
+	var raw string
+	if e := unmarshal(&raw); e == nil {
+		m := map[string]any{}
+		if e := json.Unmarshal([]byte(raw), &m); e != nil {
+			return fmt.Errorf("query.dsl is not a json object: %s", e.Error())
+		}
+		*q = m
+		return nil
+	}
+	var v any
+	if e := unmarshal(&v); e != nil {
+		return e
+	}
+	m, ok := normalizeYamlValue(v).(map[string]any)
+	if !ok {
+		return errors.New("query.dsl must be an object")
+	}
+	*q = m
+	return nil
+}
+
+// normalizeYamlValue converts map[any]any produced by yaml.v2 into map[string]any, so it can be json encoded
+func normalizeYamlValue(v any) any {
+	switch val := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[fmt.Sprintf("%v", k)] = normalizeYamlValue(item)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[k] = normalizeYamlValue(item)
+		}
+		return m
+	case []any:
+		l := make([]any, len(val))
+		for i, item := range val {
+			l[i] = normalizeYamlValue(item)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+var boolClauseKeys = map[string]bool{
+	"must":     true,
+	"should":   true,
+	"filter":   true,
+	"must_not": true,
+}
+
+var boolOptionKeys = map[string]bool{
+	"minimum_should_match": true,
+	"boost":                true,
+	"_name":                true,
+}
+
+// validateQueryObject checks q is a well-formed elasticsearch query object: {"<query type>": {...}}.
+// Compound queries are checked recursively.
+func validateQueryObject(q any, path string) error {
+	m, ok := q.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s must be an object", path)
+	}
+	if len(m) != 1 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		return fmt.Errorf("%s must have exactly one query type, got [%s]", path, strings.Join(keys, ","))
+	}
+	for queryType, body := range m {
+		if queryType == "query" {
+			return fmt.Errorf("%s should be the query object itself, remove the outer \"query\" key", path)
+		}
+		params, ok := body.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.%s must be an object", path, queryType)
+		}
+		p := path + "." + queryType
+		switch queryType {
+		case "bool":
+			for k, v := range params {
+				if boolOptionKeys[k] {
+					continue
+				}
+				if !boolClauseKeys[k] {
+					return fmt.Errorf("%s: unknown bool clause %s", p, k)
+				}
+				if e := validateQueryClauses(v, p+"."+k); e != nil {
+					return e
+				}
+			}
+		case "nested", "has_child", "has_parent", "function_score", "script_score":
+			if sub, ok := params["query"]; ok {
+				if e := validateQueryObject(sub, p+".query"); e != nil {
+					return e
+				}
+			} else if queryType != "function_score" {
+				return fmt.Errorf("%s.query is required", p)
+			}
+		case "constant_score":
+			sub, ok := params["filter"]
+			if !ok {
+				return fmt.Errorf("%s.filter is required", p)
+			}
+			if e := validateQueryObject(sub, p+".filter"); e != nil {
+				return e
+			}
+		case "dis_max":
+			if e := validateQueryClauses(params["queries"], p+".queries"); e != nil {
+				return e
+			}
+		case "boosting":
+			for _, k := range []string{"positive", "negative"} {
+				if e := validateQueryObject(params[k], p+"."+k); e != nil {
+					return e
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateQueryClauses checks a bool clause, it can be a single query object or an array of query objects
+func validateQueryClauses(v any, path string) error {
+	l, ok := v.([]any)
+	if !ok {
+		return validateQueryObject(v, path)
+	}
+	for i, item := range l {
+		if e := validateQueryObject(item, fmt.Sprintf("%s[%d]", path, i)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// SQLFetchSize is the max rows returned by a sql query
+const SQLFetchSize = 1000
+
+func validateSQL(sql string) error {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != "SELECT" {
+		return errors.New("query.sql must be a SELECT statement")
+	}
+	for _, f := range fields[1:] {
+		if strings.ToUpper(f) == "FROM" {
+			return nil
+		}
+	}
+	return errors.New("query.sql must have a FROM clause")
+}
+
+func validateESQL(esql string) error {
+	fields := strings.Fields(esql)
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != "FROM" {
+		return errors.New("query.esql must start with a FROM source command")
+	}
+	return nil
+}
+
+// validateEQL does a syntax check of EQL queries: balanced brackets and quotes,
+// `<category> where <condition>` event queries and sequence/sample queries of at least two events
+func validateEQL(eql string) error {
+	groups := []string{}
+	stack := []rune{}
+	var quote rune
+	groupStart := -1
+	runes := []rune(eql)
+	for i, c := range runes {
+		if quote != 0 {
+			if c == '\\' {
+				continue
+			}
+			if c == quote && (i == 0 || runes[i-1] != '\\') {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[':
+			if c == '[' && len(stack) == 0 {
+				groupStart = i
+			}
+			stack = append(stack, c)
+		case ')', ']':
+			open := '('
+			if c == ']' {
+				open = '['
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("unbalanced %q at position %d", c, i)
+			}
+			stack = stack[:len(stack)-1]
+			if c == ']' && len(stack) == 0 {
+				groups = append(groups, string(runes[groupStart+1:i]))
+			}
+		}
+	}
+	if quote != 0 {
+		return errors.New("unterminated string")
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %q", stack[len(stack)-1])
+	}
+	fields := strings.Fields(eql)
+	if len(fields) == 0 {
+		return errors.New("empty query")
+	}
+	switch strings.ToLower(fields[0]) {
+	case "sequence", "sample":
+		if len(groups) < 2 {
+			return fmt.Errorf("%s requires at least two [<category> where <condition>] events", fields[0])
+		}
+		for _, g := range groups {
+			if e := validateEQLEvent(g); e != nil {
+				return e
+			}
+		}
+		return nil
+	default:
+		query := strings.SplitN(eql, "|", 2)[0]
+		return validateEQLEvent(query)
+	}
+}
+
+func validateEQLEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 3 || strings.ToLower(fields[1]) != "where" {
+		return fmt.Errorf("%q is not a `<category> where <condition>` event", strings.TrimSpace(event))
+	}
+	return nil
+}
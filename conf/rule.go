@@ -2,8 +2,10 @@ package conf
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dream-mo/prom-elastic-alert/utils"
+	"github.com/dream-mo/prom-elastic-alert/utils/kql"
 	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
 	"strconv"
 	"strings"
@@ -11,94 +13,321 @@ import (
 )
 
 type Rule struct {
-	UniqueId string          `yaml:"unique_id"`
-	Enabled  bool            `yaml:"enabled" default:"true"`
-	ES       EsConfig        `yaml:"es"`
-	Index    string          `yaml:"index"`
-	RunEvery xtime.TimeLimit `yaml:"run_every"`
-	Query    struct {
+	UniqueId         string            `yaml:"unique_id"`
+	Enabled          bool              `yaml:"enabled"`
+	ES               EsConfig          `yaml:"es"`
+	Index            string            `yaml:"index"`
+	Indices          []string          `yaml:"indices"`
+	UseStrftimeIndex bool              `yaml:"use_strftime_index"`
+	RunEvery         xtime.TimeLimit   `yaml:"run_every"`
+	Schedule         Schedule          `yaml:"schedule"`
+	Timezone         string            `yaml:"timezone"`
+	ActiveTimeRanges []ActiveTimeRange `yaml:"active_time_ranges"`
+	Timestamp        TimestampConfig   `yaml:",inline"`
+	SearchOptions    SearchOptions     `yaml:"search_options"`
+	QueryDelay       xtime.TimeLimit   `yaml:"query_delay"`
+	LateTolerance    xtime.TimeLimit   `yaml:"late_tolerance"`
+	IngestedField    string            `yaml:"ingested_field"`
+	For              xtime.TimeLimit   `yaml:"for"`
+	KeepFiringFor    xtime.TimeLimit   `yaml:"keep_firing_for"`
+	Realert          xtime.TimeLimit   `yaml:"realert"`
+	ResendInterval   xtime.TimeLimit   `yaml:"resend_interval"`
+	Flapping         FlappingConfig    `yaml:"flapping"`
+	OnError          string            `yaml:"on_error" default:"keep_state"`
+	OnNoData         string            `yaml:"on_no_data" default:"resolve"`
+	Notifiers        []RuleNotifier    `yaml:"notifiers"`
+	Query            struct {
 		Type   string `yaml:"type"`
 		Config struct {
 			Timeframe xtime.TimeLimit `yaml:"timeframe"`
 			NumEvents uint            `yaml:"num_events"`
 		} `yaml:"config"`
 		QueryString string            `yaml:"query_string"`
+		DSL         QueryDSL          `yaml:"dsl"`
+		KQL         string            `yaml:"kql"`
+		SQL         string            `yaml:"sql"`
+		ESQL        string            `yaml:"esql"`
+		EQL         string            `yaml:"eql"`
+		ValueColumn string            `yaml:"value_column"`
 		Labels      map[string]string `yaml:"labels"`
 		Annotations map[string]string `yaml:"annotations"`
 	} `yaml:"query"`
 	RawContent string
 	FilePath   string
+	query      map[string]any
 }
 
-func (rl *Rule) GetQueryStringDSL(from int, size int, start time.Time, end time.Time) string {
-	q := `
-{
-    "query":{
-        "bool":{
-            "must":[
-                {
-                    "query_string":{
-                        "query": %s
-                    }
-                },
-                {
-                    "range":{
-                        "@timestamp":{
-                            "format":"strict_date_optional_time",
-                            "gte":"%s",
-                            "lte":"%s"
-                        }
-                    }
-                }
-            ]
-        }
-    },
-    "sort":[
-        {
-            "@timestamp":{
-                "order":"asc"
-            }
-        }
-    ],
-	"from": %d,
-    "size": %d
-}
-    `
-	dsl := fmt.Sprintf(q, strconv.Quote(rl.Query.QueryString), xtime.TimeFormatISO8601(start), xtime.TimeFormatISO8601(end), from, size)
-	return dsl
-}
-
-func (rl *Rule) GetQueryStringCountDSL(start time.Time, end time.Time) string {
-	q := `
-{
-    "query":{
-        "bool":{
-            "must":[
-                {
-                    "query_string":{
-                        "query": %s
-                    }
-                },
-                {
-                    "range":{
-                        "@timestamp":{
-                            "format":"strict_date_optional_time",
-                            "gte":"%s",
-                            "lte":"%s"
-                        }
-                    }
-                }
-            ]
-        }
-    }
-}
-    `
-	dsl := fmt.Sprintf(q, strconv.Quote(rl.Query.QueryString), xtime.TimeFormatISO8601(start), xtime.TimeFormatISO8601(end))
-	return dsl
+// FlappingConfig marks an alert as flapping when it changes state max_transitions times within window,
+// a flapping alert is held firing until its condition is stable for stable_for
+type FlappingConfig struct {
+	MaxTransitions uint            `yaml:"max_transitions"`
+	Window         xtime.TimeLimit `yaml:"window"`
+	StableFor      xtime.TimeLimit `yaml:"stable_for"`
+}
+
+const (
+	defaultFlappingWindow    = time.Minute * 30
+	defaultFlappingStableFor = time.Minute * 15
+)
+
+func (fc FlappingConfig) Enabled() bool {
+	return fc.MaxTransitions > 0
+}
+
+func (fc FlappingConfig) GetWindow() time.Duration {
+	if d := fc.Window.GetTimeDuration(); d > 0 {
+		return d
+	}
+	return defaultFlappingWindow
+}
+
+func (fc FlappingConfig) GetStableFor() time.Duration {
+	if d := fc.StableFor.GetTimeDuration(); d > 0 {
+		return d
+	}
+	return defaultFlappingStableFor
+}
+
+// Policies of on_error and on_no_data, applied when the rule query failed or returned no data
+const (
+	PolicyKeepState = "keep_state"
+	PolicyAlert     = "alert"
+	PolicyResolve   = "resolve"
+	PolicyIgnore    = "ignore"
+)
+
+const (
+	QueryModeQueryString = "query_string"
+	QueryModeDSL         = "dsl"
+	QueryModeKQL         = "kql"
+	QueryModeSQL         = "sql"
+	QueryModeESQL        = "esql"
+	QueryModeEQL         = "eql"
+	EQLMaxSize           = 1000
+)
+
+// GetQueryMode returns which query language the rule is written in
+func (rl *Rule) GetQueryMode() string {
+	switch {
+	case len(rl.Query.DSL) > 0:
+		return QueryModeDSL
+	case rl.Query.KQL != "":
+		return QueryModeKQL
+	case rl.Query.SQL != "":
+		return QueryModeSQL
+	case rl.Query.ESQL != "":
+		return QueryModeESQL
+	case rl.Query.EQL != "":
+		return QueryModeEQL
+	default:
+		return QueryModeQueryString
+	}
+}
+
+// IsDocumentQuery reports whether the rule query is a search api query that returns documents
+func (rl *Rule) IsDocumentQuery() bool {
+	switch rl.GetQueryMode() {
+	case QueryModeSQL, QueryModeESQL, QueryModeEQL:
+		return false
+	default:
+		return true
+	}
+}
+
+// CompileQuery validates the rule query and prepares the query clause used by every query
+func (rl *Rule) CompileQuery() error {
+	if e := rl.Timestamp.Validate(); e != nil {
+		return e
+	}
+	if e := rl.SearchOptions.Validate(); e != nil {
+		return e
+	}
+	if e := rl.ValidateSchedule(); e != nil {
+		return e
+	}
+	if (rl.IsDocumentQuery() || rl.GetQueryMode() == QueryModeEQL) && len(rl.GetIndexPatterns()) == 0 {
+		return errors.New("one of index or indices is required")
+	}
+	if e := rl.ValidateIndexPatterns(); e != nil {
+		return e
+	}
+	switch rl.GetQueryMode() {
+	case QueryModeDSL:
+		if e := validateQueryObject(map[string]any(rl.Query.DSL), "query.dsl"); e != nil {
+			return e
+		}
+		rl.query = rl.Query.DSL
+	case QueryModeKQL:
+		q, e := kql.Parse(rl.Query.KQL)
+		if e != nil {
+			return fmt.Errorf("query.kql parse error: %s", e.Error())
+		}
+		rl.query = q
+	case QueryModeSQL:
+		return validateSQL(rl.Query.SQL)
+	case QueryModeESQL:
+		if rl.ES.Version != "v8" {
+			return errors.New("query.esql requires es.version v8")
+		}
+		return validateESQL(rl.Query.ESQL)
+	case QueryModeEQL:
+		if e := validateEQL(rl.Query.EQL); e != nil {
+			return fmt.Errorf("query.eql error: %s", e.Error())
+		}
+	default:
+		if rl.Query.QueryString == "" {
+			return errors.New("one of query.query_string, query.dsl, query.kql, query.sql, query.esql or query.eql is required")
+		}
+		rl.query = map[string]any{
+			"query_string": map[string]any{
+				"query": rl.Query.QueryString,
+			},
+		}
+	}
+	return nil
+}
+
+func (rl *Rule) GetESQLBody(start time.Time, end time.Time) string {
+	m := map[string]any{
+		"query":  rl.Query.ESQL,
+		"filter": rl.GetRangeClause(start, end),
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
+}
+
+func (rl *Rule) GetEQLBody(start time.Time, end time.Time) string {
+	m := map[string]any{
+		"query":           rl.Query.EQL,
+		"filter":          rl.GetRangeClause(start, end),
+		"timestamp_field": rl.Timestamp.GetField(),
+		"size":            EQLMaxSize,
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
+}
+
+// GetQueryEnd returns the end of the query window, shifted back by query_delay so that
+// documents ingested late are still in the window when it is evaluated
+func (rl *Rule) GetQueryEnd(now time.Time) time.Time {
+	return now.Add(-rl.QueryDelay.GetTimeDuration())
+}
+
+// GetSourceFields returns the document fields fetched by the rule searches
+func (rl *Rule) GetSourceFields() []string {
+	fields := []string{rl.Timestamp.GetField()}
+	if rl.IngestedField != "" {
+		fields = append(fields, rl.IngestedField)
+	}
+	return fields
+}
+
+// GetIngestLag returns the delay between the document timestamp and the ingested_field time
+func (rl *Rule) GetIngestLag(hit map[string]any) (time.Duration, bool) {
+	if rl.IngestedField == "" {
+		return 0, false
+	}
+	ts, ok := rl.Timestamp.GetTime(hit)
+	if !ok {
+		return 0, false
+	}
+	ingested, ok := TimestampConfig{Field: rl.IngestedField, Type: xtime.TimestampISO8601}.GetTime(hit)
+	if !ok {
+		return 0, false
+	}
+	return ingested.Sub(ts), true
+}
+
+func (rl *Rule) GetMetricsIngestLagFingerprint(stat string) string {
+	f := []string{rl.UniqueId, rl.FilePath, rl.GetIndex(), stat}
+	return utils.MD5(strings.Join(f, ""))
+}
+
+// GetQueryWindow returns the time window ending at end that matches are computed over, the timeframe
+// or buffer_time when no timeframe is configured
+func (rl *Rule) GetQueryWindow(end time.Time, bufferTime time.Duration) (time.Time, time.Time) {
+	d := rl.Query.Config.Timeframe.GetTimeDuration()
+	if d == 0 {
+		d = bufferTime
+	}
+	return end.Add(-d), end
+}
+
+func (rl *Rule) GetSQLBody(start time.Time, end time.Time) string {
+	m := map[string]any{
+		"query":      rl.Query.SQL,
+		"filter":     rl.GetRangeClause(start, end),
+		"fetch_size": SQLFetchSize,
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
+}
+
+// GetQueryClause returns the user query clause, without the time range filter
+func (rl *Rule) GetQueryClause() map[string]any {
+	if rl.query == nil {
+		_ = rl.CompileQuery()
+	}
+	return rl.query
+}
+
+func (rl *Rule) GetRangeClause(start time.Time, end time.Time) map[string]any {
+	return rl.Timestamp.GetRangeClause(start, end)
+}
+
+// GetFilteredQuery returns the rule query restricted to [start, end], documents of excludeIds are
+// left out, they are the already fetched documents sharing the cursor timestamp
+func (rl *Rule) GetFilteredQuery(start time.Time, end time.Time, excludeIds ...string) map[string]any {
+	b := map[string]any{
+		"must":   []any{rl.GetQueryClause()},
+		"filter": []any{rl.GetRangeClause(start, end)},
+	}
+	if len(excludeIds) > 0 {
+		b["must_not"] = []any{
+			map[string]any{
+				"ids": map[string]any{
+					"values": excludeIds,
+				},
+			},
+		}
+	}
+	return map[string]any{
+		"bool": b,
+	}
+}
+
+func (rl *Rule) GetQueryDSL(from int, size int, start time.Time, end time.Time, excludeIds ...string) string {
+	m := map[string]any{
+		"query": rl.GetFilteredQuery(start, end, excludeIds...),
+		"sort":  rl.Timestamp.GetSort(),
+		"from":  from,
+		"size":  size,
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
+}
+
+func (rl *Rule) GetCountDSL(start time.Time, end time.Time, excludeIds ...string) string {
+	m := map[string]any{
+		"query": rl.GetFilteredQuery(start, end, excludeIds...),
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
+}
+
+// GetCountSearchDSL returns the count request as a search body, used when the count is sent within a _msearch
+func (rl *Rule) GetCountSearchDSL(start time.Time, end time.Time, excludeIds ...string) string {
+	m := map[string]any{
+		"query":            rl.GetFilteredQuery(start, end, excludeIds...),
+		"size":             0,
+		"track_total_hits": true,
+	}
+	bs, _ := json.Marshal(m)
+	return string(bs)
 }
 
 func (rl *Rule) GetMetricsQueryFingerprint(statusCode int) string {
-	f := []string{rl.UniqueId, rl.FilePath, rl.GetEsAddress(), rl.Index, strconv.Itoa(statusCode)}
+	f := []string{rl.UniqueId, rl.FilePath, rl.GetEsAddress(), rl.GetIndex(), strconv.Itoa(statusCode)}
 	return utils.MD5(strings.Join(f, ""))
 }
 
@@ -115,25 +344,29 @@ func GetMetricsOpRedisFingerprint(uniqueId string, path string, cmd string, key
 	return utils.MD5(strings.Join(f, ""))
 }
 
-func GetMetricsWebhookNotifyFingerprint(uniqueId string, path string, statusCode int) string {
-	f := []string{uniqueId, path, strconv.Itoa(statusCode)}
+func (rl *Rule) GetMetricsIncompleteQueryFingerprint(reason string) string {
+	f := []string{rl.UniqueId, rl.FilePath, rl.GetEsAddress(), rl.GetIndex(), reason}
+	return utils.MD5(strings.Join(f, ""))
+}
+
+func (rl *Rule) GetMetricsSkippedFingerprint(reason string) string {
+	f := []string{rl.UniqueId, rl.FilePath, rl.GetEsAddress(), reason}
+	return utils.MD5(strings.Join(f, ""))
+}
+
+func GetMetricsNotifyFingerprint(uniqueId string, path string, notifier string, notifierType string, status string) string {
+	f := []string{uniqueId, path, notifier, notifierType, status}
 	return utils.MD5(strings.Join(f, ""))
 }
 
-func BuildFindByIdsDSLBody(ids []string) string {
+func BuildFindByIdsDSLBody(ids []string, timestamp TimestampConfig) string {
 	m := map[string]any{
 		"query": map[string]any{
 			"ids": map[string]any{
 				"values": ids,
 			},
 		},
-		"sort": []map[string]any{
-			{
-				"@timestamp": map[string]string{
-					"order": "asc",
-				},
-			},
-		},
+		"sort": timestamp.GetSort(),
 	}
 	bs, _ := json.Marshal(m)
 	return string(bs)
@@ -160,6 +393,10 @@ properties:
     required: []
     properties:
       alertmanager: {type: object, required: [], properties: {url: {type: string}, basic_auth: {type: object, required: [], properties: {username: {type: string}, password: {type: string}}}}}
+      notifiers:
+        type: object
+        additionalProperties: {type: object, required: ["type"], properties: {type: {type: string}, config: {type: object}}}
+      default_notifiers: {type: array, items: {type: string}}
       generator: {type: object, required: [], properties: {base_url: {type: string}, expire: {type: object, required: [], properties: {days: {type: number}}}}}
   redis:
     type: object
@@ -169,6 +406,24 @@ properties:
       port: {type: number}
       password: {type: string}
       db: {type: number}
+  elasticsearch:
+    type: object
+    required: []
+    properties:
+      max_concurrent_searches: {type: number}
+      circuit_breaker: {type: object, required: [], properties: {enabled: {type: boolean}, failure_threshold: {type: number}, open_timeout: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}, days: {type: number}}}}}
+      msearch: {type: object, required: [], properties: {enabled: {type: boolean}, max_batch_size: {type: number}, batch_window_ms: {type: number}}}
+  scheduler:
+    type: object
+    required: []
+    properties:
+      workers: {type: number}
+  catch_up:
+    type: object
+    required: []
+    properties:
+      enabled: {type: boolean}
+      max_range: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}, days: {type: number}}}
   run_every:
     type: object
     required: []
@@ -196,7 +451,7 @@ properties:
 
 var RuleYamlSchema = `
 type: object
-required: ["unique_id", "es", "index", "run_every", "query"]
+required: ["unique_id", "es", "query"]
 properties:
   unique_id:
     type: string
@@ -212,6 +467,90 @@ properties:
       version: {type: string, enum: ["v7", "v8"]}
   index:
     type: string
+  indices:
+    type: array
+    items: {type: string}
+  use_strftime_index:
+    type: boolean
+  search_options:
+    type: object
+    required: []
+    properties:
+      timeout: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}}}
+      preference: {type: string}
+      routing: {type: string}
+      ignore_unavailable: {type: boolean}
+      allow_no_indices: {type: boolean}
+      allow_partial_search_results: {type: boolean}
+      track_total_hits: {type: [boolean, integer]}
+  query_delay:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+  late_tolerance:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+  ingested_field:
+    type: string
+  for:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+      days: {type: number}
+  keep_firing_for:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+      days: {type: number}
+  realert:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+      days: {type: number}
+  resend_interval:
+    type: object
+    required: []
+    properties:
+      seconds: {type: number}
+      minutes: {type: number}
+      days: {type: number}
+  flapping:
+    type: object
+    required: ["max_transitions"]
+    properties:
+      max_transitions: {type: number}
+      window: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}, days: {type: number}}}
+      stable_for: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}, days: {type: number}}}
+  on_error:
+    type: string
+    enum: ["keep_state", "alert", "resolve", "ignore"]
+  on_no_data:
+    type: string
+    enum: ["keep_state", "alert", "resolve", "ignore"]
+  notifiers:
+    type: array
+    items:
+      oneOf:
+        - {type: string}
+        - {type: object, required: ["name"], properties: {name: {type: string}, config: {type: object}}}
+  timestamp_field:
+    type: string
+  timestamp_type:
+    type: string
+    enum: ["iso8601", "epoch_millis", "epoch_seconds", "custom"]
+  timestamp_format:
+    type: string
   run_every:
     type: object
     required: []
@@ -219,12 +558,32 @@ properties:
       seconds: {type: number}
       minutes: {type: number}
       days: {type: number}
+  schedule:
+    type: object
+    required: []
+    properties:
+      cron: {type: string}
+      offset: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}}}
+      jitter: {type: object, required: [], properties: {seconds: {type: number}, minutes: {type: number}}}
+      priority: {type: integer}
+  timezone:
+    type: string
+  active_time_ranges:
+    type: array
+    items: {type: object, required: ["start", "end"], properties: {days: {type: array, items: {type: string}}, start: {type: string}, end: {type: string}}}
   query:
     type: object
-    required: ["type", "query_string", "config", "labels", "annotations"]
+    required: ["type", "config", "labels", "annotations"]
+    oneOf: [{required: ["query_string"]}, {required: ["dsl"]}, {required: ["kql"]}, {required: ["sql"]}, {required: ["esql"]}, {required: ["eql"]}]
     properties:
       type: {type: string, enum: ["frequency"]}
       query_string: {type: string}
+      dsl: {type: [object, string]}
+      kql: {type: string}
+      sql: {type: string}
+      esql: {type: string}
+      eql: {type: string}
+      value_column: {type: string}
       config: {type: object, required: ["timeframe", "num_events"], properties: {timeframe: {type: object, required: [], properties: {minutes: {type: number}}}, num_events: {type: number}}}
       labels: {type: object, required: ["alertname"], properties: {alertname: {type: string}, instance: {type: string}, severity: {type: string}, for_time: {type: string}, threshold: {type: string}}}
       annotations: {type: object, required: [], properties: {description: {type: string}, summary: {type: string}}}
@@ -0,0 +1,137 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"github.com/robfig/cron/v3"
+	"strings"
+	"time"
+)
+
+// Schedule is the rule evaluation schedule, a cron expression takes precedence over run_every.
+// Offset and jitter delay every evaluation, higher priority rules are evaluated first when all workers are busy.
+type Schedule struct {
+	Cron     string          `yaml:"cron"`
+	Offset   xtime.TimeLimit `yaml:"offset"`
+	Jitter   xtime.TimeLimit `yaml:"jitter"`
+	Priority int             `yaml:"priority"`
+}
+
+// ActiveTimeRange is a daily time range [start, end) in the rule timezone, e.g. 08:00-20:00.
+// An end before the start wraps past midnight, days limits the range to some weekdays.
+type ActiveTimeRange struct {
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"SUN": time.Sunday,
+	"MON": time.Monday,
+	"TUE": time.Tuesday,
+	"WED": time.Wednesday,
+	"THU": time.Thursday,
+	"FRI": time.Friday,
+	"SAT": time.Saturday,
+}
+
+// ValidateSchedule checks the cron expression, the timezone and the active time ranges
+func (rl *Rule) ValidateSchedule() error {
+	if rl.Schedule.Cron != "" {
+		if _, e := cron.ParseStandard(rl.Schedule.Cron); e != nil {
+			return fmt.Errorf("schedule.cron parse error: %s", e.Error())
+		}
+	} else if rl.RunEvery.GetSeconds() == 0 {
+		return errors.New("one of run_every or schedule.cron is required")
+	}
+	if rl.Timezone != "" {
+		if _, e := time.LoadLocation(rl.Timezone); e != nil {
+			return fmt.Errorf("timezone error: %s", e.Error())
+		}
+	}
+	for i, tr := range rl.ActiveTimeRanges {
+		if _, e := parseClock(tr.Start); e != nil {
+			return fmt.Errorf("active_time_ranges[%d].start %s", i, e.Error())
+		}
+		if _, e := parseClock(tr.End); e != nil {
+			return fmt.Errorf("active_time_ranges[%d].end %s", i, e.Error())
+		}
+		for _, d := range tr.Days {
+			if _, ok := weekdays[strings.ToUpper(d)]; !ok {
+				return fmt.Errorf("active_time_ranges[%d].days invalid day: %s", i, d)
+			}
+		}
+	}
+	return nil
+}
+
+// GetLocation returns the rule timezone, the application zone by default
+func (rl *Rule) GetLocation() *time.Location {
+	if rl.Timezone != "" {
+		if loc, e := time.LoadLocation(rl.Timezone); e == nil {
+			return loc
+		}
+	}
+	return xtime.Zone
+}
+
+// IsActive reports whether t is within one of the active time ranges, rules without ranges are always active
+func (rl *Rule) IsActive(t time.Time) bool {
+	if len(rl.ActiveTimeRanges) == 0 {
+		return true
+	}
+	t = t.In(rl.GetLocation())
+	for _, tr := range rl.ActiveTimeRanges {
+		if tr.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tr ActiveTimeRange) contains(t time.Time) bool {
+	start, _ := parseClock(tr.Start)
+	end, _ := parseClock(tr.End)
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	if end <= start && clock < end {
+		// Wrapped range, the time after midnight belongs to the range of the previous day
+		day = (day + 6) % 7
+	}
+	if !tr.hasDay(day) {
+		return false
+	}
+	if start < end {
+		return clock >= start && clock < end
+	}
+	return clock >= start || clock < end
+}
+
+func (tr ActiveTimeRange) hasDay(day time.Weekday) bool {
+	if len(tr.Days) == 0 {
+		return true
+	}
+	for _, d := range tr.Days {
+		if weekdays[strings.ToUpper(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses HH:MM or HH:MM:SS into the duration since midnight, 24:00 is the end of the day
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	layout := "15:04"
+	if strings.Count(s, ":") == 2 {
+		layout = "15:04:05"
+	}
+	t, e := time.Parse(layout, s)
+	if e != nil {
+		return 0, fmt.Errorf("must be HH:MM, got %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
@@ -0,0 +1,54 @@
+package conf
+
+import (
+	"errors"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"strings"
+	"time"
+)
+
+// SearchOptions are the elasticsearch request parameters of the rule count and search requests
+type SearchOptions struct {
+	Timeout                   xtime.TimeLimit `yaml:"timeout"`
+	Preference                string          `yaml:"preference"`
+	Routing                   string          `yaml:"routing"`
+	IgnoreUnavailable         *bool           `yaml:"ignore_unavailable"`
+	AllowNoIndices            *bool           `yaml:"allow_no_indices"`
+	AllowPartialSearchResults *bool           `yaml:"allow_partial_search_results"`
+	// TrackTotalHits is true, false or the number of hits to count accurately
+	TrackTotalHits any `yaml:"track_total_hits"`
+}
+
+func (so SearchOptions) Validate() error {
+	switch so.TrackTotalHits.(type) {
+	case nil, bool, int:
+		return nil
+	default:
+		return errors.New("search_options.track_total_hits must be a boolean or an integer")
+	}
+}
+
+func (so SearchOptions) GetTimeout() time.Duration {
+	return so.Timeout.GetTimeDuration()
+}
+
+func (so SearchOptions) GetRouting() []string {
+	routing := []string{}
+	for _, r := range strings.Split(so.Routing, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			routing = append(routing, r)
+		}
+	}
+	return routing
+}
+
+// GetSearchOptions returns the rule search options, missing concrete indices are ignored
+// by default when the index names are expanded by use_strftime_index
+func (rl *Rule) GetSearchOptions() SearchOptions {
+	opts := rl.SearchOptions
+	if opts.IgnoreUnavailable == nil && rl.UseStrftimeIndex {
+		ignore := true
+		opts.IgnoreUnavailable = &ignore
+	}
+	return opts
+}
@@ -0,0 +1,89 @@
+package conf
+
+import (
+	"errors"
+	"github.com/dream-mo/prom-elastic-alert/utils"
+	"github.com/dream-mo/prom-elastic-alert/utils/xtime"
+	"time"
+)
+
+const DefaultTimestampField = "@timestamp"
+
+// TimestampConfig describes which document field holds the event time and how it is stored
+type TimestampConfig struct {
+	Field  string `yaml:"timestamp_field" json:"field" default:"@timestamp"`
+	Type   string `yaml:"timestamp_type" json:"type" default:"iso8601"`
+	Format string `yaml:"timestamp_format" json:"format"`
+}
+
+func (tc TimestampConfig) Validate() error {
+	if tc.Type == xtime.TimestampCustom && tc.Format == "" {
+		return errors.New("timestamp_format is required by custom timestamp_type")
+	}
+	return nil
+}
+
+func (tc TimestampConfig) GetField() string {
+	if tc.Field == "" {
+		return DefaultTimestampField
+	}
+	return tc.Field
+}
+
+// GetTime returns the event time of a search hit
+func (tc TimestampConfig) GetTime(hit map[string]any) (time.Time, bool) {
+	source, _ := hit["_source"].(map[string]any)
+	v, ok := utils.GetFieldValue(source, tc.GetField())
+	if !ok {
+		return time.Time{}, false
+	}
+	t, e := xtime.ParseTimestamp(v, tc.Type, tc.Format)
+	return t, e == nil
+}
+
+// GetRangeClause returns the range filter of [start, end]. Epoch timestamps are compared as numbers
+// so that they also work on numeric fields, other date fields are compared in ISO8601.
+func (tc TimestampConfig) GetRangeClause(start time.Time, end time.Time) map[string]any {
+	var params map[string]any
+	switch tc.Type {
+	case xtime.TimestampEpochMillis:
+		params = map[string]any{
+			"gte": start.UnixMilli(),
+			"lte": end.UnixMilli(),
+		}
+	case xtime.TimestampEpochSeconds:
+		params = map[string]any{
+			"gte": start.Unix(),
+			"lte": end.Unix(),
+		}
+	default:
+		params = map[string]any{
+			"format": "strict_date_optional_time",
+			"gte":    xtime.TimeFormatISO8601(start),
+			"lte":    xtime.TimeFormatISO8601(end),
+		}
+	}
+	return map[string]any{
+		"range": map[string]any{
+			tc.GetField(): params,
+		},
+	}
+}
+
+// GetPrecision returns the precision of the range bounds sent to elasticsearch
+func (tc TimestampConfig) GetPrecision() time.Duration {
+	if tc.Type == xtime.TimestampEpochSeconds {
+		return time.Second
+	}
+	return time.Millisecond
+}
+
+func (tc TimestampConfig) GetSort() []map[string]any {
+	return []map[string]any{
+		{
+			tc.GetField(): map[string]string{
+				"order": "asc",
+			},
+		},
+	}
+}
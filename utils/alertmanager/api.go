@@ -21,17 +21,18 @@ func HttpSendAlert(url string, username string, password string, payload string)
 	if err != nil {
 		t := fmt.Sprintf("http.NewRequest error: %s", err.Error())
 		logger.Logger.Errorln(t)
+		return false, 499
 	}
 	req.Header.Set("Content-Type", contentType)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
 	resp, e := requests.Do(req)
 	defer func() {
 		if resp != nil {
 			_ = resp.Body.Close()
 		}
 	}()
-	if username != "" {
-		req.SetBasicAuth(username, password)
-	}
 	if e != nil {
 		t := fmt.Sprintf("send alert to alertmanager error: %s", e.Error())
 		logger.Logger.Errorln(t)
@@ -0,0 +1,482 @@
+// Package kql parses Kibana Query Language expressions and translates them into elasticsearch query DSL.
+//
+// Supported syntax:
+//
+//	status: 500                      match
+//	message: "connection refused"    match_phrase
+//	host.name: web-*                 wildcard value
+//	error.code: *                    exists
+//	bytes >= 1024                    range (<, <=, >, >=)
+//	status: (500 or 502)             value list with or / and / not
+//	items: { name: foo and qty > 1 } nested query
+//	not a: 1 and (b: 2 or c: 3)      boolean operators, or < and < not
+//	timeout                          free text over all fields
+package kql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenLParen
+	tokenRParen
+	tokenLBrace
+	tokenRBrace
+	tokenColon
+	tokenRange
+	tokenQuoted
+	tokenLiteral
+	tokenOr
+	tokenAnd
+	tokenNot
+)
+
+type token struct {
+	typ tokenType
+	pos int
+	// value is the unescaped text of the token
+	value string
+	// lucene is the value escaped for query_string, keeping unescaped * as wildcard
+	lucene   string
+	wildcard bool
+}
+
+const (
+	luceneSpecialChars = `+-=&|><!(){}[]^"~*?:\/ `
+	literalStopChars   = " \t\r\n():{}<>\""
+)
+
+func lex(input string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(input)
+	i := 0
+	for i < len(runes) {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{typ: tokenLParen, pos: i, value: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{typ: tokenRParen, pos: i, value: ")"})
+			i++
+		case c == '{':
+			tokens = append(tokens, token{typ: tokenLBrace, pos: i, value: "{"})
+			i++
+		case c == '}':
+			tokens = append(tokens, token{typ: tokenRBrace, pos: i, value: "}"})
+			i++
+		case c == ':':
+			tokens = append(tokens, token{typ: tokenColon, pos: i, value: ":"})
+			i++
+		case c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			tokens = append(tokens, token{typ: tokenRange, pos: i, value: op})
+			i += len(op)
+		case c == '"':
+			start := i
+			i++
+			b := strings.Builder{}
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", start)
+			}
+			tokens = append(tokens, token{typ: tokenQuoted, pos: start, value: b.String()})
+		default:
+			start := i
+			value := strings.Builder{}
+			lucene := strings.Builder{}
+			escaped := false
+			wildcard := false
+			for i < len(runes) {
+				r := runes[i]
+				if r == '\\' {
+					if i+1 >= len(runes) {
+						return nil, fmt.Errorf("dangling escape at position %d", i)
+					}
+					next := runes[i+1]
+					value.WriteRune(next)
+					if strings.ContainsRune(luceneSpecialChars, next) {
+						lucene.WriteRune('\\')
+					}
+					lucene.WriteRune(next)
+					escaped = true
+					i += 2
+					continue
+				}
+				if strings.ContainsRune(literalStopChars, r) {
+					break
+				}
+				if r == '*' {
+					wildcard = true
+					value.WriteRune(r)
+					lucene.WriteRune(r)
+				} else {
+					value.WriteRune(r)
+					if strings.ContainsRune(luceneSpecialChars, r) {
+						lucene.WriteRune('\\')
+					}
+					lucene.WriteRune(r)
+				}
+				i++
+			}
+			t := token{typ: tokenLiteral, pos: start, value: value.String(), lucene: lucene.String(), wildcard: wildcard}
+			if !escaped {
+				switch strings.ToLower(t.value) {
+				case "or":
+					t.typ = tokenOr
+				case "and":
+					t.typ = tokenAnd
+				case "not":
+					t.typ = tokenNot
+				}
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	tokens = append(tokens, token{typ: tokenEOF, pos: len(runes)})
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// nested is the path prefix of the nested query being parsed
+	nested string
+}
+
+// Parse translates a KQL expression into an elasticsearch query object
+func Parse(input string) (map[string]any, error) {
+	if strings.TrimSpace(input) == "" {
+		return map[string]any{"match_all": map[string]any{}}, nil
+	}
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return q, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.unexpected(t)
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.typ == tokenEOF {
+		return fmt.Errorf("unexpected end of query at position %d", t.pos)
+	}
+	return fmt.Errorf("unexpected %q at position %d", t.value, t.pos)
+}
+
+func (p *parser) parseOr() (map[string]any, error) {
+	return p.parseBinary(tokenOr, p.parseAnd, combineOr)
+}
+
+func (p *parser) parseAnd() (map[string]any, error) {
+	return p.parseBinary(tokenAnd, p.parseNot, combineAnd)
+}
+
+func (p *parser) parseBinary(op tokenType, operand func() (map[string]any, error), combine func([]any) map[string]any) (map[string]any, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []any{first}
+	for p.peek().typ == op {
+		p.next()
+		q, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, q)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	return combine(clauses), nil
+}
+
+func (p *parser) parseNot() (map[string]any, error) {
+	if p.peek().typ == tokenNot {
+		p.next()
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return negate(q), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (map[string]any, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenLParen:
+		p.next()
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case tokenLiteral:
+		after := p.tokens[p.pos+1]
+		if after.typ == tokenColon || after.typ == tokenRange {
+			return p.parseField()
+		}
+		v := p.parseLiteral()
+		return freeTextQuery(v), nil
+	case tokenQuoted:
+		p.next()
+		return map[string]any{
+			"multi_match": map[string]any{
+				"query":   t.value,
+				"type":    "phrase",
+				"lenient": true,
+			},
+		}, nil
+	default:
+		return nil, p.unexpected(t)
+	}
+}
+
+func (p *parser) parseField() (map[string]any, error) {
+	f := p.next()
+	field := f.value
+	if p.nested != "" {
+		field = p.nested + "." + field
+	}
+	op := p.next()
+	if op.typ == tokenRange {
+		v := p.next()
+		if v.typ != tokenLiteral && v.typ != tokenQuoted {
+			return nil, p.unexpected(v)
+		}
+		return rangeQuery(field, op.value, v.value), nil
+	}
+	switch p.peek().typ {
+	case tokenLBrace:
+		p.next()
+		parent := p.nested
+		p.nested = field
+		inner, err := p.parseOr()
+		p.nested = parent
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRBrace); err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"nested": map[string]any{
+				"path":       field,
+				"query":      inner,
+				"score_mode": "none",
+			},
+		}, nil
+	case tokenLParen:
+		p.next()
+		q, err := p.parseValueOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return q, nil
+	default:
+		return p.parseValue(field)
+	}
+}
+
+func (p *parser) parseValueOr(field string) (map[string]any, error) {
+	return p.parseBinary(tokenOr, func() (map[string]any, error) {
+		return p.parseBinary(tokenAnd, func() (map[string]any, error) {
+			return p.parseValueNot(field)
+		}, combineAnd)
+	}, combineOr)
+}
+
+func (p *parser) parseValueNot(field string) (map[string]any, error) {
+	switch p.peek().typ {
+	case tokenNot:
+		p.next()
+		q, err := p.parseValueNot(field)
+		if err != nil {
+			return nil, err
+		}
+		return negate(q), nil
+	case tokenLParen:
+		p.next()
+		q, err := p.parseValueOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return q, nil
+	default:
+		return p.parseValue(field)
+	}
+}
+
+func (p *parser) parseValue(field string) (map[string]any, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenQuoted:
+		p.next()
+		return map[string]any{
+			"match_phrase": map[string]any{field: t.value},
+		}, nil
+	case tokenLiteral:
+		return fieldQuery(field, p.parseLiteral()), nil
+	default:
+		return nil, p.unexpected(t)
+	}
+}
+
+// parseLiteral joins consecutive unquoted words into one value, as KQL does for `message: hello world`
+func (p *parser) parseLiteral() token {
+	t := p.next()
+	for p.peek().typ == tokenLiteral {
+		after := p.tokens[p.pos+1]
+		if after.typ == tokenColon || after.typ == tokenRange {
+			break
+		}
+		n := p.next()
+		t.value += " " + n.value
+		t.lucene += `\ ` + n.lucene
+		t.wildcard = t.wildcard || n.wildcard
+	}
+	return t
+}
+
+func fieldQuery(field string, v token) map[string]any {
+	// Only an unescaped * is a wildcard, `field: \*` matches a literal asterisk
+	if v.wildcard && v.lucene == "*" {
+		return map[string]any{
+			"exists": map[string]any{"field": field},
+		}
+	}
+	if v.wildcard || strings.Contains(field, "*") {
+		return map[string]any{
+			"query_string": map[string]any{
+				"fields":           []string{field},
+				"query":            v.lucene,
+				"analyze_wildcard": true,
+			},
+		}
+	}
+	return map[string]any{
+		"match": map[string]any{field: v.value},
+	}
+}
+
+func freeTextQuery(v token) map[string]any {
+	if v.wildcard && v.lucene == "*" {
+		return map[string]any{"match_all": map[string]any{}}
+	}
+	if v.wildcard {
+		return map[string]any{
+			"query_string": map[string]any{
+				"query":            v.lucene,
+				"analyze_wildcard": true,
+			},
+		}
+	}
+	return map[string]any{
+		"multi_match": map[string]any{
+			"query":   v.value,
+			"type":    "best_fields",
+			"lenient": true,
+		},
+	}
+}
+
+func rangeQuery(field string, op string, value string) map[string]any {
+	ops := map[string]string{
+		"<":  "lt",
+		"<=": "lte",
+		">":  "gt",
+		">=": "gte",
+	}
+	return map[string]any{
+		"range": map[string]any{
+			field: map[string]any{ops[op]: value},
+		},
+	}
+}
+
+func combineOr(clauses []any) map[string]any {
+	return map[string]any{
+		"bool": map[string]any{
+			"should":               clauses,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+func combineAnd(clauses []any) map[string]any {
+	return map[string]any{
+		"bool": map[string]any{
+			"filter": clauses,
+		},
+	}
+}
+
+func negate(q map[string]any) map[string]any {
+	return map[string]any{
+		"bool": map[string]any{
+			"must_not": []any{q},
+		},
+	}
+}
@@ -0,0 +1,92 @@
+package kql
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", ``, `{"match_all":{}}`},
+		{"match", `status: 500`, `{"match":{"status":"500"}}`},
+		{"joined words", `message: hello world`, `{"match":{"message":"hello world"}}`},
+		{"free text", `timeout`, `{"multi_match":{"lenient":true,"query":"timeout","type":"best_fields"}}`},
+
+		{"and before or", `a: 1 or b: 2 and c: 3`,
+			`{"bool":{"minimum_should_match":1,"should":[{"match":{"a":"1"}},{"bool":{"filter":[{"match":{"b":"2"}},{"match":{"c":"3"}}]}}]}}`},
+		{"not before and", `not a: 1 and b: 2`,
+			`{"bool":{"filter":[{"bool":{"must_not":[{"match":{"a":"1"}}]}},{"match":{"b":"2"}}]}}`},
+		{"parentheses", `(a: 1 or b: 2) and c: 3`,
+			`{"bool":{"filter":[{"bool":{"minimum_should_match":1,"should":[{"match":{"a":"1"}},{"match":{"b":"2"}}]}},{"match":{"c":"3"}}]}}`},
+		{"value list", `status: (500 or not 502)`,
+			`{"bool":{"minimum_should_match":1,"should":[{"match":{"status":"500"}},{"bool":{"must_not":[{"match":{"status":"502"}}]}}]}}`},
+
+		{"nested", `items: { name: foo and qty > 1 }`,
+			`{"nested":{"path":"items","query":{"bool":{"filter":[{"match":{"items.name":"foo"}},{"range":{"items.qty":{"gt":"1"}}}]}},"score_mode":"none"}}`},
+		{"nested in nested", `user: { address: { city: x } }`,
+			`{"nested":{"path":"user","query":{"nested":{"path":"user.address","query":{"match":{"user.address.city":"x"}},"score_mode":"none"}},"score_mode":"none"}}`},
+
+		{"range gte", `bytes >= 1024`, `{"range":{"bytes":{"gte":"1024"}}}`},
+		{"range lte", `bytes <= 1024`, `{"range":{"bytes":{"lte":"1024"}}}`},
+		{"range quoted", `bytes < "10"`, `{"range":{"bytes":{"lt":"10"}}}`},
+
+		{"wildcard value", `host.name: web-*`,
+			`{"query_string":{"analyze_wildcard":true,"fields":["host.name"],"query":"web\\-*"}}`},
+		{"exists", `error.code: *`, `{"exists":{"field":"error.code"}}`},
+		{"match all", `*`, `{"match_all":{}}`},
+		{"escaped asterisk value", `error.code: \*`, `{"match":{"error.code":"*"}}`},
+		{"escaped asterisk free text", `\*`, `{"multi_match":{"lenient":true,"query":"*","type":"best_fields"}}`},
+		{"escaped colon", `path: a\:b`, `{"match":{"path":"a:b"}}`},
+		{"escaped keyword", `a: \or`, `{"match":{"a":"or"}}`},
+		{"escaped space in field", `x\ or: 1`, `{"match":{"x or":"1"}}`},
+
+		{"quoted phrase", `message: "connection refused"`, `{"match_phrase":{"message":"connection refused"}}`},
+		{"quoted escaped quote", `message: "say \"hi\""`, `{"match_phrase":{"message":"say \"hi\""}}`},
+		{"quoted keyword", `a: "or"`, `{"match_phrase":{"a":"or"}}`},
+		{"quoted free text", `"quoted phrase"`, `{"multi_match":{"lenient":true,"query":"quoted phrase","type":"phrase"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %s", tt.input, err)
+			}
+			got, _ := json.Marshal(q)
+			if string(got) != tt.want {
+				t.Errorf("Parse(%q)\n got: %s\nwant: %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`a: 1 and`, `unexpected end of query at position 8`},
+		{`(a: 1`, `unexpected end of query at position 5`},
+		{`a: 1 )`, `unexpected ")" at position 5`},
+		{`a: { b: 1`, `unexpected end of query at position 9`},
+		{`bytes >`, `unexpected end of query at position 7`},
+		{`bytes > (1)`, `unexpected "(" at position 8`},
+		{`or`, `unexpected "or" at position 0`},
+		{`a: "x`, `unterminated quoted string at position 3`},
+		{`a: b\`, `dangling escape at position 4`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			if err == nil {
+				t.Fatalf("Parse(%q) expected an error", tt.input)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Parse(%q) error\n got: %s\nwant: %s", tt.input, err, tt.want)
+			}
+		})
+	}
+}
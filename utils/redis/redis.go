@@ -8,7 +8,13 @@ import (
 )
 
 const (
-	AlertQueueListKey = "prom_elastic_alert:alerts:list"
+	AlertQueueListKey      = "prom_elastic_alert:alerts:list"
+	RuleCursorKeyPrefix    = "prom_elastic_alert:cursor:"
+	RuleEvaluatedKeyPrefix = "prom_elastic_alert:evaluated:"
+	AlertSentKeyPrefix     = "prom_elastic_alert:sent:"
+	CatchUpKeyPrefix       = "prom_elastic_alert:catch_up:"
+	AlertStateHashKey      = "prom_elastic_alert:alerts:state"
+	FlapStateHashKey       = "prom_elastic_alert:flaps:state"
 )
 
 var Client *redis.Client
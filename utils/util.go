@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"os"
+	"strings"
 )
 
 func PathExists(path string) (bool, error) {
@@ -32,3 +33,23 @@ func MD5(raw string) string {
 	bs := md5.Sum([]byte(raw))
 	return fmt.Sprintf("%x", bs)
 }
+
+// GetFieldValue returns the value of a dotted field path, e.g event.created, from a document source.
+// Both flattened keys and nested objects are supported.
+func GetFieldValue(source map[string]any, path string) (any, bool) {
+	if v, ok := source[path]; ok {
+		return v, true
+	}
+	parts := strings.Split(path, ".")
+	for i := 1; i < len(parts); i++ {
+		head := strings.Join(parts[:i], ".")
+		sub, ok := source[head].(map[string]any)
+		if !ok {
+			continue
+		}
+		if v, ok := GetFieldValue(sub, strings.Join(parts[i:], ".")); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
@@ -1,10 +1,10 @@
 package xelastic
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/dream-mo/prom-elastic-alert/conf"
 	"github.com/dream-mo/prom-elastic-alert/utils/logger"
 	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
@@ -18,59 +18,109 @@ type ElasticClientV7 struct {
 
 var ctx = context.Background()
 
-func (ec *ElasticClientV7) FindByDSL(index string, dsl string, source []string) ([]any, int, int) {
+func (ec *ElasticClientV7) FindByDSL(indices []string, dsl string, source []string, opts conf.SearchOptions) SearchResult {
 	req := esapi.SearchRequest{
-		Index:        []string{index},
-		DocumentType: []string{"_doc"},
-		Body:         strings.NewReader(dsl),
+		Index:                     indices,
+		DocumentType:              []string{"_doc"},
+		Body:                      strings.NewReader(dsl),
+		Preference:                opts.Preference,
+		Routing:                   opts.GetRouting(),
+		Timeout:                   opts.GetTimeout(),
+		IgnoreUnavailable:         opts.IgnoreUnavailable,
+		AllowNoIndices:            opts.AllowNoIndices,
+		AllowPartialSearchResults: opts.AllowPartialSearchResults,
+		TrackTotalHits:            opts.TrackTotalHits,
 	}
 	if source != nil {
 		req.Source = source
 	}
-	dst := &bytes.Buffer{}
-	_ = json.Compact(dst, []byte(dsl))
 	res, e := req.Do(ctx, ec.client)
-	hits := []any{}
-	totalValue := 0
 	if e != nil {
-		t := fmt.Sprintf("%s : %s", index, e.Error())
+		t := fmt.Sprintf("%s : %s", strings.Join(indices, ","), e.Error())
 		logger.Logger.Errorln(t)
-		return hits, totalValue, res.StatusCode
-	} else {
-		m := ec.parseResponseBody(res)
-		j, ok := m["hits"]
-		if ok {
-			hitsVal := j.(map[string]any)
-			hits = hitsVal["hits"].([]any)
-			total := hitsVal["total"].(map[string]any)
-			totalFloat := total["value"].(float64)
-			totalValue = int(totalFloat)
-		}
-		return hits, totalValue, res.StatusCode
+		return parseSearchResult(nil, HttpTransportErrorCode)
 	}
+	defer res.Body.Close()
+	return parseSearchResult(ec.parseResponseBody(res), res.StatusCode)
 }
 
-func (ec *ElasticClientV7) CountByDSL(index string, dsl string) (int, int) {
+func (ec *ElasticClientV7) CountByDSL(indices []string, dsl string, opts conf.SearchOptions) SearchResult {
 	req := esapi.CountRequest{
-		Index:        []string{index},
-		DocumentType: []string{"_doc"},
-		Body:         strings.NewReader(dsl),
+		Index:             indices,
+		DocumentType:      []string{"_doc"},
+		Body:              strings.NewReader(dsl),
+		Preference:        opts.Preference,
+		Routing:           opts.GetRouting(),
+		IgnoreUnavailable: opts.IgnoreUnavailable,
+		AllowNoIndices:    opts.AllowNoIndices,
 	}
 	res, e := req.Do(ctx, ec.client)
 	if e != nil {
-		t := fmt.Sprintf("%s : %s", index, e.Error())
+		t := fmt.Sprintf("%s : %s", strings.Join(indices, ","), e.Error())
 		logger.Logger.Errorln(t)
-		return 0, res.StatusCode
-	} else {
-		m := ec.parseResponseBody(res)
-		c, ok := m["count"]
-		if ok {
-			countFloat := c.(float64)
-			return int(countFloat), res.StatusCode
-		} else {
-			return 0, res.StatusCode
+		return parseSearchResult(nil, HttpTransportErrorCode)
+	}
+	defer res.Body.Close()
+	return parseSearchResult(ec.parseResponseBody(res), res.StatusCode)
+}
+
+func (ec *ElasticClientV7) QueryBySQL(body string) ([]map[string]any, int, error) {
+	req := esapi.SQLQueryRequest{
+		Body:   strings.NewReader(body),
+		Format: "json",
+	}
+	res, e := req.Do(ctx, ec.client)
+	rows := []map[string]any{}
+	if e != nil {
+		return rows, HttpTransportErrorCode, e
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return rows, res.StatusCode, parseErrorReason(res.Body)
+	}
+	m := ec.parseResponseBody(res)
+	rows = parseTabularRows(m)
+	if cursor, ok := m["cursor"].(string); ok && cursor != "" {
+		// Rows over fetch_size are not needed, release the cursor on the server side
+		clear := esapi.SQLClearCursorRequest{
+			Body: strings.NewReader(fmt.Sprintf(`{"cursor":%q}`, cursor)),
 		}
+		if r, e := clear.Do(ctx, ec.client); e == nil {
+			_ = r.Body.Close()
+		}
+	}
+	return rows, res.StatusCode, nil
+}
+
+func (ec *ElasticClientV7) QueryByEQL(indices []string, body string) (EQLResult, int, error) {
+	req := esapi.EqlSearchRequest{
+		Index: strings.Join(indices, ","),
+		Body:  strings.NewReader(body),
+	}
+	res, e := req.Do(ctx, ec.client)
+	if e != nil {
+		return parseEQLResult(nil), HttpTransportErrorCode, e
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return parseEQLResult(nil), res.StatusCode, parseErrorReason(res.Body)
+	}
+	return parseEQLResult(ec.parseResponseBody(res)), res.StatusCode, nil
+}
+
+func (ec *ElasticClientV7) MultiSearch(items []MultiSearchItem, maxConcurrentSearches int) ([]SearchResult, int) {
+	req := esapi.MsearchRequest{
+		Body:                  strings.NewReader(buildMultiSearchBody(items)),
+		MaxConcurrentSearches: &maxConcurrentSearches,
+	}
+	res, e := req.Do(ctx, ec.client)
+	if e != nil {
+		t := fmt.Sprintf("msearch: %s", e.Error())
+		logger.Logger.Errorln(t)
+		return parseMultiSearchResult(nil, len(items), HttpTransportErrorCode), HttpTransportErrorCode
 	}
+	defer res.Body.Close()
+	return parseMultiSearchResult(ec.parseResponseBody(res), len(items), res.StatusCode), res.StatusCode
 }
 
 func (ec *ElasticClientV7) parseResponseBody(resp *esapi.Response) map[string]any {
@@ -1,4 +1,62 @@
 package xelastic
 
+import (
+	"encoding/json"
+	"github.com/dream-mo/prom-elastic-alert/conf"
+	"github.com/dream-mo/prom-elastic-alert/utils/logger"
+	elasticsearch8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io"
+	"strings"
+)
+
+// ElasticClientV8 only runs ES|QL queries, every other query goes through ElasticClientV7
 type ElasticClientV8 struct {
+	client *elasticsearch8.Client
+}
+
+func newElasticClientV8(esConfig conf.EsConfig) ESQLClient {
+	client, err := elasticsearch8.NewClient(elasticsearch8.Config{
+		Addresses: esConfig.Addresses,
+		Username:  esConfig.Username,
+		Password:  esConfig.Password,
+	})
+	if err != nil {
+		logger.Logger.Errorln(err)
+		return nil
+	}
+	return &ElasticClientV8{
+		client: client,
+	}
+}
+
+func (ec *ElasticClientV8) QueryByESQL(body string) ([]map[string]any, int, error) {
+	req := esapi.EsqlQueryRequest{
+		Body:   strings.NewReader(body),
+		Format: "json",
+	}
+	res, e := req.Do(ctx, ec.client)
+	rows := []map[string]any{}
+	if e != nil {
+		return rows, HttpTransportErrorCode, e
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return rows, res.StatusCode, parseErrorReason(res.Body)
+	}
+	m := ec.parseResponseBody(res)
+	return parseTabularRows(m), res.StatusCode, nil
+}
+
+func (ec *ElasticClientV8) parseResponseBody(resp *esapi.Response) map[string]any {
+	s := map[string]any{}
+	if !resp.IsError() {
+		bs, _ := io.ReadAll(resp.Body)
+		if !json.Valid(bs) {
+			return s
+		} else {
+			_ = json.Unmarshal(bs, &s)
+		}
+	}
+	return s
 }
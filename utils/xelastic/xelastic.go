@@ -1,16 +1,211 @@
 package xelastic
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dream-mo/prom-elastic-alert/conf"
 	"github.com/dream-mo/prom-elastic-alert/utils/logger"
 	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
+	"io"
+	"strings"
+)
+
+const (
+	// HttpTransportErrorCode is returned as status code when the request never got a response
+	HttpTransportErrorCode = 499
 )
 
 type ElasticClient interface {
-	FindByDSL(index string, dsl string, source []string) ([]any, int, int)
-	CountByDSL(index string, dsl string) (int, int)
+	FindByDSL(indices []string, dsl string, source []string, opts conf.SearchOptions) SearchResult
+	CountByDSL(indices []string, dsl string, opts conf.SearchOptions) SearchResult
+	QueryBySQL(body string) ([]map[string]any, int, error)
+	QueryByEQL(indices []string, body string) (EQLResult, int, error)
+	// MultiSearch runs the items in one _msearch request, elasticsearch runs at most maxConcurrentSearches of them at a time
+	MultiSearch(items []MultiSearchItem, maxConcurrentSearches int) ([]SearchResult, int)
+}
+
+// ESQLClient runs ES|QL queries, which need the v8 client
+type ESQLClient interface {
+	QueryByESQL(body string) ([]map[string]any, int, error)
+}
+
+// MultiSearchItem is one search of a _msearch request
+type MultiSearchItem struct {
+	Indices []string
+	DSL     string
+	Source  []string
+	Opts    conf.SearchOptions
+}
+
+// buildMultiSearchBody builds the _msearch ndjson body, search options are moved into the header and body lines
+func buildMultiSearchBody(items []MultiSearchItem) string {
+	b := strings.Builder{}
+	for _, item := range items {
+		header := map[string]any{
+			"index": item.Indices,
+		}
+		if item.Opts.Preference != "" {
+			header["preference"] = item.Opts.Preference
+		}
+		if routing := item.Opts.GetRouting(); len(routing) > 0 {
+			header["routing"] = strings.Join(routing, ",")
+		}
+		if item.Opts.IgnoreUnavailable != nil {
+			header["ignore_unavailable"] = *item.Opts.IgnoreUnavailable
+		}
+		if item.Opts.AllowNoIndices != nil {
+			header["allow_no_indices"] = *item.Opts.AllowNoIndices
+		}
+		if item.Opts.AllowPartialSearchResults != nil {
+			header["allow_partial_search_results"] = *item.Opts.AllowPartialSearchResults
+		}
+		body := map[string]any{}
+		_ = json.Unmarshal([]byte(item.DSL), &body)
+		if item.Source != nil {
+			body["_source"] = item.Source
+		}
+		if timeout := item.Opts.GetTimeout(); timeout > 0 {
+			body["timeout"] = fmt.Sprintf("%dms", timeout.Milliseconds())
+		}
+		if _, ok := body["track_total_hits"]; !ok && item.Opts.TrackTotalHits != nil {
+			body["track_total_hits"] = item.Opts.TrackTotalHits
+		}
+		h, _ := json.Marshal(header)
+		bs, _ := json.Marshal(body)
+		b.Write(h)
+		b.WriteByte('\n')
+		b.Write(bs)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// parseMultiSearchResult splits the _msearch response into one result per item
+func parseMultiSearchResult(m map[string]any, size int, statusCode int) []SearchResult {
+	results := make([]SearchResult, size)
+	responses, _ := m["responses"].([]any)
+	for i := range results {
+		if i >= len(responses) {
+			results[i] = parseSearchResult(nil, statusCode)
+			continue
+		}
+		resp, _ := responses[i].(map[string]any)
+		status, ok := resp["status"].(float64)
+		if !ok {
+			status = float64(statusCode)
+		}
+		results[i] = parseSearchResult(resp, int(status))
+	}
+	return results
+}
+
+// EQLResult is the EQL search response, Events is set by event queries and Sequences by sequence queries
+type EQLResult struct {
+	Events    []any
+	Sequences [][]any
+}
+
+func parseEQLResult(m map[string]any) EQLResult {
+	result := EQLResult{
+		Events:    []any{},
+		Sequences: [][]any{},
+	}
+	hits, ok := m["hits"].(map[string]any)
+	if !ok {
+		return result
+	}
+	if events, ok := hits["events"].([]any); ok {
+		result.Events = events
+	}
+	if sequences, ok := hits["sequences"].([]any); ok {
+		for _, item := range sequences {
+			seq, _ := item.(map[string]any)
+			events, _ := seq["events"].([]any)
+			result.Sequences = append(result.Sequences, events)
+		}
+	}
+	return result
 }
 
+// SearchResult is the result of search and count requests, Total is the count of count requests
+type SearchResult struct {
+	Hits       []any
+	Total      int
+	StatusCode int
+	TimedOut   bool
+	// Partial is true when some shards failed, the result is based on incomplete data
+	Partial bool
+}
+
+func parseSearchResult(m map[string]any, statusCode int) SearchResult {
+	result := SearchResult{
+		Hits:       []any{},
+		StatusCode: statusCode,
+	}
+	if hitsVal, ok := m["hits"].(map[string]any); ok {
+		if hits, ok := hitsVal["hits"].([]any); ok {
+			result.Hits = hits
+		}
+		if total, ok := hitsVal["total"].(map[string]any); ok {
+			totalFloat, _ := total["value"].(float64)
+			result.Total = int(totalFloat)
+		}
+	}
+	if c, ok := m["count"].(float64); ok {
+		result.Total = int(c)
+	}
+	result.TimedOut, _ = m["timed_out"].(bool)
+	if shards, ok := m["_shards"].(map[string]any); ok {
+		failed, _ := shards["failed"].(float64)
+		result.Partial = failed > 0
+	}
+	return result
+}
+
+// parseErrorReason extracts error.reason from an elasticsearch error response body
+func parseErrorReason(body io.Reader) error {
+	bs, _ := io.ReadAll(body)
+	m := map[string]any{}
+	if e := json.Unmarshal(bs, &m); e != nil {
+		return errors.New(string(bs))
+	}
+	if errVal, ok := m["error"].(map[string]any); ok {
+		if reason, ok := errVal["reason"].(string); ok {
+			return fmt.Errorf("%v: %s", errVal["type"], reason)
+		}
+	}
+	return errors.New(string(bs))
+}
+
+// parseTabularRows converts {"columns": [{"name": ...}], "values"|"rows": [[...]]} into column keyed rows
+func parseTabularRows(m map[string]any) []map[string]any {
+	rows := []map[string]any{}
+	columns, _ := m["columns"].([]any)
+	values, ok := m["rows"].([]any)
+	if !ok {
+		values, _ = m["values"].([]any)
+	}
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		col, _ := c.(map[string]any)
+		names[i], _ = col["name"].(string)
+	}
+	for _, v := range values {
+		items, _ := v.([]any)
+		row := make(map[string]any, len(names))
+		for i, item := range items {
+			if i < len(names) {
+				row[names[i]] = item
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// NewElasticClient returns the v7 client for every es.version, elasticsearch 8 clusters are queried
+// with it as well. The v8 client is only used by ES|QL queries, see NewESQLClient.
 func NewElasticClient(esConfig conf.EsConfig, version string) ElasticClient {
 	client, err := elasticsearch7.NewClient(elasticsearch7.Config{
 		Addresses: esConfig.Addresses,
@@ -26,3 +221,8 @@ func NewElasticClient(esConfig conf.EsConfig, version string) ElasticClient {
 	}
 	return c
 }
+
+// NewESQLClient returns the v8 client for ES|QL queries, which the v7 client does not support
+func NewESQLClient(esConfig conf.EsConfig) ESQLClient {
+	return newElasticClientV8(esConfig)
+}
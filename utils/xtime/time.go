@@ -1,6 +1,8 @@
 package xtime
 
 import (
+	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -53,3 +55,66 @@ func Parse(s string) time.Time {
 	t, _ := time.ParseInLocation(time.RFC3339, s, Zone)
 	return t
 }
+
+const (
+	TimestampISO8601      = "iso8601"
+	TimestampEpochMillis  = "epoch_millis"
+	TimestampEpochSeconds = "epoch_seconds"
+	TimestampCustom       = "custom"
+)
+
+var iso8601Layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses a document timestamp value of the given type, layout is only used by custom type
+func ParseTimestamp(v any, typ string, layout string) (time.Time, error) {
+	switch typ {
+	case TimestampEpochMillis, TimestampEpochSeconds:
+		var n float64
+		switch val := v.(type) {
+		case float64:
+			n = val
+		case int64:
+			n = float64(val)
+		case int:
+			n = float64(val)
+		case string:
+			f, e := strconv.ParseFloat(val, 64)
+			if e != nil {
+				return time.Time{}, e
+			}
+			n = f
+		default:
+			return time.Time{}, fmt.Errorf("timestamp %v is not a number", v)
+		}
+		if typ == TimestampEpochSeconds {
+			n *= 1000
+		}
+		return time.UnixMilli(int64(n)).In(Zone), nil
+	case TimestampCustom:
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("timestamp %v is not a string", v)
+		}
+		return time.ParseInLocation(layout, s, Zone)
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("timestamp %v is not a string", v)
+		}
+		var err error
+		for _, l := range iso8601Layouts {
+			t, e := time.ParseInLocation(l, s, Zone)
+			if e == nil {
+				return t, nil
+			}
+			err = e
+		}
+		return time.Time{}, err
+	}
+}